@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/yaolixiao/golang_common/lib"
+)
+
+// 配置加密工具
+//
+// 生成密钥:  confsecret -genkey
+// 加密:      APP_CONF_SECRET_KEY=xxx confsecret -encrypt < plain.txt
+// 解密:      APP_CONF_SECRET_KEY=xxx confsecret -decrypt 'ENC(...)'
+// 也可以用 -keyfile 指定密钥文件
+// 明文从标准输入读取，不作为命令行参数，避免留在 shell 历史和 ps 中，终端中运行时提示输入一行
+func main() {
+	genKey := flag.Bool("genkey", false, "generate a random base64 secret key")
+	encrypt := flag.Bool("encrypt", false, "encrypt the plain value read from stdin")
+	decrypt := flag.String("decrypt", "", "ENC(...) value to decrypt")
+	keyFile := flag.String("keyfile", "", "secret key file, default read from env "+lib.ConfSecretKeyEnv)
+	flag.Parse()
+
+	if *genKey {
+		key, err := lib.GenConfSecretKey()
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(key)
+		return
+	}
+	if !*encrypt && *decrypt == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *keyFile != "" {
+		lib.ConfSecretKeyFile = *keyFile
+	}
+	key, err := lib.LoadConfSecretKey()
+	if err != nil {
+		fail(err)
+	}
+	if key == nil {
+		fail(fmt.Errorf("secret key not set. env=%v or -keyfile", lib.ConfSecretKeyEnv))
+	}
+
+	if *encrypt {
+		plain, err := readPlain(os.Stdin)
+		if err != nil {
+			fail(err)
+		}
+		value, err := lib.EncryptConfValue(plain, key)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(value)
+	}
+	if *decrypt != "" {
+		value, err := lib.DecryptConfValue(*decrypt, key)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(value)
+	}
+}
+
+// 读取待加密的明文，去掉末尾的换行，终端中只读取一行
+func readPlain(f *os.File) (string, error) {
+	var data string
+	if info, err := f.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "value to encrypt: ")
+		line, err := bufio.NewReader(f).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		data = line
+	} else {
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			return "", err
+		}
+		data = string(b)
+	}
+	data = strings.TrimRight(data, "\r\n")
+	if data == "" {
+		return "", fmt.Errorf("empty value to encrypt")
+	}
+	return data, nil
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+	os.Exit(1)
+}
@@ -3,8 +3,13 @@ module github.com/yaolixiao/golang_common
 go 1.14
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.5.0
+	github.com/alicebob/miniredis/v2 v2.23.0
+	github.com/fsnotify/fsnotify v1.4.7
+	github.com/gomodule/redigo v1.8.3
+	github.com/mitchellh/mapstructure v1.1.2
 	github.com/spf13/viper v1.7.1
-	github.com/stretchr/testify v1.4.0 // indirect
+	github.com/vmihailenco/msgpack/v4 v4.3.12
 	github.com/yaolixiao/gorm v0.0.0-20201226161228-eb120828a965
 	golang.org/x/sys v0.0.0-20200116001909-b77594299b42 // indirect
 	gopkg.in/yaml.v2 v2.2.8 // indirect
@@ -0,0 +1,255 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/vmihailenco/msgpack/v4"
+	"github.com/yaolixiao/gorm"
+)
+
+// 数据不存在，loader 返回该错误、sql.ErrNoRows 或 gorm.ErrRecordNotFound 时缓存空结果
+var ErrCacheNotFound = errors.New("cache: not found")
+
+// 缓存值的序列化方式
+type CacheCodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error)      { return msgpack.Marshal(v) }
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
+
+var (
+	JSONCodec    CacheCodec = jsonCodec{}
+	MsgpackCodec CacheCodec = msgpackCodec{}
+)
+
+// 缓存中值的首字节，区分正常值和空结果
+const (
+	cacheValueFlag    = 'v'
+	cacheNotFoundFlag = 'n'
+)
+
+const defaultCacheLoadTimeout = 10 * time.Second
+
+// 缓存命中统计
+type CacheStats struct {
+	Hits       uint64
+	Misses     uint64
+	NotFound   uint64 // 命中空结果的次数，计入 Hits
+	LoadErrors uint64
+}
+
+// 基于 redis_map 中 name 对应连接池的旁路缓存
+//
+// 缓存未命中时调用 loader 加载并写入缓存，同一个 key 的并发加载只执行一次
+// 写入时 ttl 随机增加 0 ~ ttl*Jitter，避免大量 key 同时过期
+type Cache struct {
+	stats CacheStats // 原子操作，放在首位保证 64 位对齐
+
+	Prefix      string        // key 前缀
+	Codec       CacheCodec    // 默认 JSONCodec
+	Jitter      float64       // 默认 0.1
+	NotFoundTTL time.Duration // 空结果缓存时间，默认 1 分钟，小于 0 时不缓存空结果
+	LoadTimeout time.Duration // loader 超时时间，默认 10 秒，小于 0 时不限制
+
+	name string
+
+	lock  sync.Mutex
+	calls map[string]*cacheCall
+}
+
+// 进行中的加载
+type cacheCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func NewCache(redisName string) *Cache {
+	return &Cache{
+		Codec:       JSONCodec,
+		Jitter:      0.1,
+		NotFoundTTL: time.Minute,
+		LoadTimeout: defaultCacheLoadTimeout,
+		name:        redisName,
+		calls:       map[string]*cacheCall{},
+	}
+}
+
+// 从缓存读取 key 到 dst，未命中时调用 loader 加载并缓存
+// 数据不存在时返回 ErrCacheNotFound，redis 不可用时直接调用 loader
+// 并发加载时等待中的调用受各自 ctx 控制，loader 使用只带 trace 的独立 ctx，超时时间为 LoadTimeout
+// 调用方取消后加载仍会继续，结果写入缓存并返回给其他等待中的调用
+func (c *Cache) GetOrLoad(ctx context.Context, key string, ttl time.Duration, dst interface{}, loader func(ctx context.Context) (interface{}, error)) error {
+	trace := GetTrace(ctx)
+	fullKey := c.Prefix + key
+
+	data, err := redis.Bytes(RedisLogDo(trace, c.name, "GET", fullKey))
+	if err == nil && len(data) > 0 {
+		hits := atomic.AddUint64(&c.stats.Hits, 1)
+		notFound := data[0] == cacheNotFoundFlag
+		if notFound {
+			atomic.AddUint64(&c.stats.NotFound, 1)
+		}
+		Log.TagInfo(trace, DLTagCacheHit, map[string]interface{}{
+			"name":      c.name,
+			"key":       fullKey,
+			"not_found": notFound,
+			"hits":      hits,
+			"misses":    atomic.LoadUint64(&c.stats.Misses),
+		})
+		return c.decode(data, dst)
+	}
+	misses := atomic.AddUint64(&c.stats.Misses, 1)
+	Log.TagInfo(trace, DLTagCacheMiss, map[string]interface{}{
+		"name":   c.name,
+		"key":    fullKey,
+		"hits":   atomic.LoadUint64(&c.stats.Hits),
+		"misses": misses,
+	})
+
+	call := c.load(trace, fullKey, ttl, loader)
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if call.err != nil {
+		return call.err
+	}
+	return c.decode(call.data, dst)
+}
+
+// 合并同一个 key 的并发加载
+func (c *Cache) load(trace *TraceContext, fullKey string, ttl time.Duration, loader func(ctx context.Context) (interface{}, error)) *cacheCall {
+	c.lock.Lock()
+	if call, ok := c.calls[fullKey]; ok {
+		c.lock.Unlock()
+		return call
+	}
+	call := &cacheCall{done: make(chan struct{})}
+	if c.calls == nil {
+		c.calls = map[string]*cacheCall{}
+	}
+	c.calls[fullKey] = call
+	c.lock.Unlock()
+
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				call.err = fmt.Errorf("cache loader panic=%v", err)
+			}
+			if call.err != nil && call.err != ErrCacheNotFound {
+				atomic.AddUint64(&c.stats.LoadErrors, 1)
+			}
+			c.lock.Lock()
+			delete(c.calls, fullKey)
+			c.lock.Unlock()
+			close(call.done)
+		}()
+		ctx := WithTrace(context.Background(), trace)
+		if timeout := c.loadTimeout(); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		call.data, call.err = c.fill(ctx, trace, fullKey, ttl, loader)
+	}()
+	return call
+}
+
+// 调用 loader 并写入缓存
+func (c *Cache) fill(ctx context.Context, trace *TraceContext, fullKey string, ttl time.Duration, loader func(ctx context.Context) (interface{}, error)) ([]byte, error) {
+	value, err := loader(ctx)
+	if err == ErrCacheNotFound || err == sql.ErrNoRows || gorm.IsRecordNotFoundError(err) {
+		if c.NotFoundTTL >= 0 {
+			c.set(trace, fullKey, []byte{cacheNotFoundFlag}, c.notFoundTTL())
+		}
+		return nil, ErrCacheNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := c.codec().Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	data := append([]byte{cacheValueFlag}, encoded...)
+	c.set(trace, fullKey, data, ttl)
+	return data, nil
+}
+
+func (c *Cache) set(trace *TraceContext, fullKey string, data []byte, ttl time.Duration) {
+	if c.Jitter > 0 {
+		ttl += time.Duration(rand.Int63n(int64(float64(ttl)*c.Jitter) + 1))
+	}
+	ms := ttl.Milliseconds()
+	if ms <= 0 {
+		return
+	}
+	RedisLogDo(trace, c.name, "SET", fullKey, data, "PX", ms)
+}
+
+func (c *Cache) decode(data []byte, dst interface{}) error {
+	if data[0] == cacheNotFoundFlag {
+		return ErrCacheNotFound
+	}
+	if data[0] != cacheValueFlag {
+		return fmt.Errorf("cache: invalid value flag %q", data[0])
+	}
+	return c.codec().Unmarshal(data[1:], dst)
+}
+
+// 删除缓存
+func (c *Cache) Delete(ctx context.Context, key string) error {
+	_, err := RedisLogDo(GetTrace(ctx), c.name, "DEL", c.Prefix+key)
+	return err
+}
+
+// 获取命中统计
+func (c *Cache) Stats() CacheStats {
+	return CacheStats{
+		Hits:       atomic.LoadUint64(&c.stats.Hits),
+		Misses:     atomic.LoadUint64(&c.stats.Misses),
+		NotFound:   atomic.LoadUint64(&c.stats.NotFound),
+		LoadErrors: atomic.LoadUint64(&c.stats.LoadErrors),
+	}
+}
+
+func (c *Cache) codec() CacheCodec {
+	if c.Codec == nil {
+		return JSONCodec
+	}
+	return c.Codec
+}
+
+func (c *Cache) notFoundTTL() time.Duration {
+	if c.NotFoundTTL == 0 {
+		return time.Minute
+	}
+	return c.NotFoundTTL
+}
+
+func (c *Cache) loadTimeout() time.Duration {
+	if c.LoadTimeout == 0 {
+		return defaultCacheLoadTimeout
+	}
+	return c.LoadTimeout
+}
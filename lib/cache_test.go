@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yaolixiao/gorm"
+)
+
+// 测试旁路缓存
+func TestCache(t *testing.T) {
+	s := startTestRedis(t)
+	defer s.Close()
+	ConfRedisMap = &RedisMapConf{List: map[string]*RedisConf{
+		"default": {ProxyList: []string{s.Addr()}},
+	}}
+	if err := InitRedisPool(); err != nil {
+		t.Fatal(err)
+	}
+	defer CloseRedis()
+
+	type user struct {
+		Id   int
+		Name string
+	}
+	var loads int32
+	loader := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(50 * time.Millisecond)
+		return &user{Id: 1, Name: "foo"}, nil
+	}
+	ctx := WithTrace(context.Background(), NewTrace())
+
+	for _, codec := range []CacheCodec{JSONCodec, MsgpackCodec} {
+		atomic.StoreInt32(&loads, 0)
+		s.FlushAll()
+		cache := NewCache("default")
+		cache.Prefix = "user:"
+		cache.Codec = codec
+
+		// 并发未命中只加载一次
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				u := &user{}
+				if err := cache.GetOrLoad(ctx, "1", time.Minute, u, loader); err != nil || u.Name != "foo" {
+					t.Errorf("user=%+v err=%v", u, err)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := atomic.LoadInt32(&loads); n != 1 {
+			t.Fatalf("loads=%d", n)
+		}
+
+		u := &user{}
+		if err := cache.GetOrLoad(ctx, "1", time.Minute, u, loader); err != nil || u.Id != 1 || atomic.LoadInt32(&loads) != 1 {
+			t.Fatalf("user=%+v err=%v loads=%d", u, err, loads)
+		}
+		if stats := cache.Stats(); stats.Hits == 0 || stats.Hits+stats.Misses != 11 {
+			t.Fatalf("stats=%+v", stats)
+		}
+		// ttl 增加随机抖动
+		if ttl := s.TTL("user:1"); ttl < time.Minute || ttl > time.Minute+6*time.Second {
+			t.Fatalf("ttl=%v", ttl)
+		}
+	}
+
+	// 空结果缓存
+	cache := NewCache("default")
+	cache.NotFoundTTL = 10 * time.Second
+	notFound := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		return nil, gorm.ErrRecordNotFound
+	}
+	atomic.StoreInt32(&loads, 0)
+	for i := 0; i < 2; i++ {
+		if err := cache.GetOrLoad(ctx, "missing", time.Minute, &user{}, notFound); err != ErrCacheNotFound {
+			t.Fatalf("err=%v", err)
+		}
+	}
+	if atomic.LoadInt32(&loads) != 1 || cache.Stats().NotFound != 1 {
+		t.Fatalf("loads=%d stats=%+v", loads, cache.Stats())
+	}
+
+	// 加载失败不缓存
+	fail := errors.New("db down")
+	for i := 0; i < 2; i++ {
+		err := cache.GetOrLoad(ctx, "fail", time.Minute, &user{}, func(ctx context.Context) (interface{}, error) {
+			return nil, fail
+		})
+		if err != fail {
+			t.Fatalf("err=%v", err)
+		}
+	}
+	if stats := cache.Stats(); stats.LoadErrors != 2 || s.Exists("fail") {
+		t.Fatalf("stats=%+v", stats)
+	}
+	if err := cache.Delete(ctx, "missing"); err != nil || s.Exists("missing") {
+		t.Fatalf("delete err=%v", err)
+	}
+
+	// 第一个调用取消后加载继续，其他等待中的调用拿到结果并写入缓存
+	atomic.StoreInt32(&loads, 0)
+	cancelCtx, cancel := context.WithCancel(ctx)
+	first := make(chan error, 1)
+	go func() {
+		first <- cache.GetOrLoad(cancelCtx, "1", time.Minute, &user{}, func(ctx context.Context) (interface{}, error) {
+			atomic.AddInt32(&loads, 1)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(100 * time.Millisecond):
+			}
+			return &user{Id: 1, Name: "bar"}, nil
+		})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Fatalf("first err=%v", err)
+	}
+	u := &user{}
+	if err := cache.GetOrLoad(ctx, "1", time.Minute, u, loader); err != nil || u.Name != "bar" {
+		t.Fatalf("user=%+v err=%v", u, err)
+	}
+	if atomic.LoadInt32(&loads) != 1 || !s.Exists("1") {
+		t.Fatalf("loads=%d", loads)
+	}
+
+	// loader 超时
+	cache.LoadTimeout = 20 * time.Millisecond
+	err := cache.GetOrLoad(ctx, "slow", time.Minute, &user{}, func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("slow err=%v", err)
+	}
+}
@@ -1,14 +1,15 @@
 package lib
 
 import (
-	"os"
 	"github.com/spf13/viper"
 	dlog "github.com/yaolixiao/golang_common/log"
 	"github.com/yaolixiao/gorm"
 	"database/sql"
 	"io/ioutil"
-	"bytes"
+	"path/filepath"
 	"strings"
+	"fmt"
+	"time"
 )
 
 type BaseConf struct {
@@ -35,7 +36,7 @@ type LogConfConsoleWriter struct {
 }
 
 type LogConfig struct {
-	Level string `mapstructure:"log_level"`
+	Level string `mapstructure:"log_level" validate:"oneof=trace debug info warning error fatal"`
 	FW LogConfFileWriter `mapstructure:"file_writer"`
 	CW LogConfConsoleWriter `mapstructure:"console_writer"`
 }
@@ -45,12 +46,18 @@ type RedisMapConf struct {
 }
 
 type RedisConf struct {
-	ProxyList 	 []string `mapstructure:"proxy_list"`
+	ProxyList 	 []string `mapstructure:"proxy_list" validate:"required"`
 	Password  	 string `mapstructure:"password"`
-	Db 		  	 int `mapstructure:"db"`
-	ConnTimeout  int `mapstructure:"conn_timeout"`
-	ReadTimeout  int `mapstructure:"read_timeout"`
-	WriteTimeout int `mapstructure:"write_timeout"`
+	Db 		  	 int `mapstructure:"db" validate:"min=0"`
+	ConnTimeout  int `mapstructure:"conn_timeout" validate:"min=0"` // 毫秒
+	ReadTimeout  int `mapstructure:"read_timeout" validate:"min=0"` // 毫秒
+	WriteTimeout int `mapstructure:"write_timeout" validate:"min=0"` // 毫秒
+	MaxIdle      int `mapstructure:"max_idle" validate:"min=0"` // 空闲连接数，默认 10
+	MaxActive    int `mapstructure:"max_active" validate:"min=0"`
+	IdleTimeout  int `mapstructure:"idle_timeout" validate:"min=0"` // 秒
+	Balance      string `mapstructure:"balance" validate:"oneof=round_robin random"` // 默认 round_robin
+	MaxFails     int `mapstructure:"max_fails" validate:"min=0"` // 连续失败次数达到后摘除，默认 3
+	FailTimeout  int `mapstructure:"fail_timeout" validate:"min=0"` // 摘除时长，毫秒，默认 10000
 }
 
 type MysqlMapConf struct {
@@ -59,10 +66,22 @@ type MysqlMapConf struct {
 
 type MySQLConf struct {
 	DriverName string `mapstructure:"list"`
-	DataSourceName string `mapstructure:"data_source_name"`
-	MaxOpenConn int `mapstructure:"max_open_conn"`
-	MaxIdleConn int `mapstructure:"max_idle_conn"`
-	MaxConnLifeTime int `mapstructure:"max_conn_life_time"`
+	DataSourceName string `mapstructure:"data_source_name" validate:"required"`
+	MaxOpenConn int `mapstructure:"max_open_conn" validate:"min=0"`
+	MaxIdleConn int `mapstructure:"max_idle_conn" validate:"min=0"`
+	MaxConnLifeTime int `mapstructure:"max_conn_life_time" validate:"min=0"`
+	QueryTimeout int `mapstructure:"query_timeout" validate:"min=0"` // 毫秒，0 为不限制，见 DBPoolLogQueryContext
+	// 从库 DSN，只对 GetDBRoutePool/GetGormRoutePool 返回的读写分离连接池生效，见 DBPool
+	// 为兼容已有调用方，GetDBPool、GetGormPool、DBDefaultPool、GORMDefaultPool 仍然只使用主库
+	Slaves []string `mapstructure:"slaves"`
+	SlaveWeights []int `mapstructure:"slave_weights"` // 从库权重，不配置时平均分配
+	SlaveCheckInterval int `mapstructure:"slave_check_interval" validate:"min=0"` // 秒，默认 5
+	SlowThreshold int `mapstructure:"slow_threshold_ms" validate:"min=0"` // 毫秒，超过时按 DLTagMySqlSlow 记录，0 为不检测
+	SlowExplain bool `mapstructure:"slow_explain"` // 慢 SELECT 执行 EXPLAIN 并记录执行计划
+	SlowExplainInterval int `mapstructure:"slow_explain_interval" validate:"min=0"` // 秒，同一 sql 指纹 EXPLAIN 的最小间隔，默认 60
+	RedactColumns []string `mapstructure:"redact_columns"` // 列名正则，匹配完整列名，不区分大小写，对应的绑定参数在日志中替换为 ***
+	RedactMaxLen int `mapstructure:"redact_max_len" validate:"min=0"` // 字符数，日志中超过时截断绑定参数，0 为不截断
+	RedactHash bool `mapstructure:"redact_hash"` // 匹配 redact_columns 的绑定参数记录 sha256 前 8 字节而不是 ***
 }
 
 var ConfBase *BaseConf
@@ -70,42 +89,164 @@ var ConfRedis *RedisConf
 var ConfRedisMap *RedisMapConf
 var DBMapPool map[string]*sql.DB
 var GORMMapPool map[string]*gorm.DB
+var DBRouteMapPool map[string]*DBPool // 读写分离，见 GetDBRoutePool
+var GORMRouteMapPool map[string]*gorm.DB // 读写分离，见 GetGormRoutePool
 var DBDefaultPool *sql.DB
 var GORMDefaultPool *gorm.DB
 var ViperConfMap map[string]*viper.Viper
 
+// 配置项来源 文件名 => 配置项 => 配置层
+var confSources map[string]map[string]string
+
+// InitBaseConf 是否已经设置过日志
+var baseLogSetup bool
+
 // 初始化配置文件
-// 设置支持 .toml配置文件
+// 支持 .toml .yaml .yml .json .ini .properties 配置文件，按扩展名识别格式
+// 同名文件按 ConfLayers 的顺序逐层合并，字符串中的 ${...} 在全部文件加载后替换，见 confInterpolator
 // 将配置文件内容读取到全局变量 ViperConfMap
 func InitViperConf() error {
-	f, err := os.Open(ConfEnvPath + "/")
+	names, err := listConfNames()
 	if err != nil {
 		return err
 	}
+	if len(names) == 0 && !isConfDir(ConfEnvPath) {
+		return fmt.Errorf("open config path [%v] fail", ConfEnvPath)
+	}
 
-	fileList, err := f.Readdir(1024)
-	if err !=  nil {
+	confMap := make(map[string]*viper.Viper)
+	sourceMap := make(map[string]map[string]string)
+	literals := make(map[string]bool)
+	for _, name := range names {
+		// 使用viper读取配置内容
+		v, sources, literal, err := loadViperConf(name)
+		if err != nil {
+			return err
+		}
+		confMap[name] = v
+		sourceMap[name] = sources
+		for key := range literal {
+			literals[name+"."+key] = true
+		}
+	}
+	if err := interpolateConf(confMap, names, literals); err != nil {
 		return err
 	}
 
-	for _, f0 := range fileList {
-		if !f0.IsDir() {
-			bts, err := ioutil.ReadFile(ConfEnvPath + "/" + f0.Name())
-			if err != nil {
-				return err
+	confLock.Lock()
+	ViperConfMap = confMap
+	confSources = sourceMap
+	confLock.Unlock()
+	return nil
+}
+
+// 列出所有配置层中的配置文件名，同一配置层中有同名不同格式的文件时返回错误
+func listConfNames() ([]string, error) {
+	names := []string{}
+	for _, dir := range ConfLayers() {
+		fileList, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		confFiles := make(map[string]string)
+		for _, f0 := range fileList {
+			if f0.IsDir() {
+				continue
+			}
+			if _, ok := GetConfType(f0.Name()); !ok {
+				continue
 			}
-			// 使用viper读取配置内容
-			v := viper.New()
-			v.SetConfigType("toml")
-			v.ReadConfig(bytes.NewBuffer(bts))
-			if ViperConfMap == nil {
-				ViperConfMap = make(map[string]*viper.Viper)
+			name := confFileName(f0.Name())
+			if other, ok := confFiles[name]; ok {
+				return nil, fmt.Errorf("config file [%v] conflict in [%v]. files=[%v %v]", name, dir, other, f0.Name())
+			}
+			confFiles[name] = f0.Name()
+			if !InArrayString(name, names) {
+				names = append(names, name)
 			}
-			filenameArr := strings.Split(f0.Name(), ".")
-			ViperConfMap[filenameArr[0]] = v
 		}
 	}
-	return nil
+	return names, nil
+}
+
+// 读取 name 配置文件，按 ConfLayers 的顺序逐层合并，然后应用环境变量覆盖、解密 ENC(...) 值
+// 返回每个配置项的来源: 配置层文件夹，或 env:环境变量名，以及不做 ${...} 替换的配置项，见 confLiteralKeys
+// 所有配置层都没有该文件时返回 nil
+func loadViperConf(name string) (*viper.Viper, map[string]string, map[string]bool, error) {
+	var v *viper.Viper
+	sources := make(map[string]string)
+	for _, dir := range ConfLayers() {
+		files, err := findConfFiles(dir, name)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if len(files) == 0 {
+			continue
+		}
+		layer, err := readViperConf(dir + "/" + files[0])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, key := range layer.AllKeys() {
+			sources[key] = dir
+		}
+		if v == nil {
+			v = layer
+		} else if err := v.MergeConfigMap(layer.AllSettings()); err != nil {
+			return nil, nil, nil, fmt.Errorf("merge config [%v] fail. err=%v", dir+"/"+files[0], err)
+		}
+	}
+	if v == nil {
+		return nil, nil, nil, nil
+	}
+	overrides := applyConfEnv(name, v)
+	for key, env := range overrides {
+		sources[key] = confEnvSource + env
+	}
+	decrypted, err := decryptConf(name, v)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return v, sources, confLiteralKeys(overrides, decrypted), nil
+}
+
+// 来自环境变量或解密的值按原样使用，其中的 ${ 不视为变量
+func confLiteralKeys(overrides map[string]string, decrypted []string) map[string]bool {
+	literal := make(map[string]bool, len(overrides)+len(decrypted))
+	for key := range overrides {
+		literal[key] = true
+	}
+	for _, key := range decrypted {
+		literal[key] = true
+	}
+	return literal
+}
+
+// 获取配置项的来源，如 GetConfSource("base.log.log_level")
+// 返回提供该值的配置层文件夹，如 conf/common，被环境变量覆盖时返回 env:环境变量名
+// 配置项不存在时返回空字符串
+func GetConfSource(key string) string {
+	keys := strings.SplitN(key, ".", 2)
+	if len(keys) < 2 {
+		return ""
+	}
+	confLock.RLock()
+	defer confLock.RUnlock()
+	return confSources[keys[0]][strings.ToLower(keys[1])]
+}
+
+// 配置文件名去掉扩展名，作为 ViperConfMap 的键，与 findConfFiles 一致，base.bak.toml 对应 base.bak
+func confFileName(fileName string) string {
+	return strings.TrimSuffix(fileName, filepath.Ext(fileName))
+}
+
+// 获取配置文件对应的 viper 实例
+func getViperConf(name string) (*viper.Viper, bool) {
+	confLock.RLock()
+	defer confLock.RUnlock()
+	v, ok := ViperConfMap[name]
+	return v, ok
 }
 
 func InitBaseConf(path string) error {
@@ -149,46 +290,213 @@ func InitBaseConf(path string) error {
 			Color: ConfBase.Log.CW.Color,
 		},
 	}
+	// 重复初始化时先关闭之前的日志，避免重复注册输出
+	if baseLogSetup {
+		dlog.Close()
+	}
+	baseLogSetup = true
 	if err := dlog.SetupDefaultLogWithConf(logConf); err != nil {
-		panic(err)
+		return err
 	}
 	dlog.SetLayout("2006-01-02T15:04:05.000")
 	return nil
 }
 
+// 关闭 InitBaseConf 设置的日志，等待缓冲的日志写入并刷新输出，可重复调用
+func CloseBaseLog() {
+	if baseLogSetup {
+		baseLogSetup = false
+		dlog.Close()
+	}
+}
+
+// 解析 redis_map 配置，ConfRedis 为 [list.default]
 func InitRedisConf(path string) error {
-	ConfRedis = &RedisConf{}
-	err := ParseConfig(path, ConfRedis)
+	redisMap := &RedisMapConf{}
+	err := ParseConfig(path, redisMap)
 	if err != nil {
 		return err
 	}
-	ConfRedisMap = &RedisMapConf{}
-	redisMap := make(map[string]*RedisConf)
-	redisMap["default"] = ConfRedis
-	ConfRedisMap.List = redisMap
+	ConfRedisMap = redisMap
+	ConfRedis = redisMap.List["default"]
 	return nil
 }
 
+// 拆分配置键 文件名.配置项，返回文件对应的 viper 实例和配置项
+// 文件不存在或缺少配置项时 ok 为 false
+func splitConfKey(key string) (v *viper.Viper, subKey string, ok bool) {
+	keys := strings.SplitN(key, ".", 2)
+	if len(keys) < 2 || keys[1] == "" {
+		return nil, "", false
+	}
+	v, ok = getViperConf(keys[0])
+	if !ok || v == nil {
+		return nil, "", false
+	}
+	return v, keys[1], true
+}
+
+// 判断配置项是否存在
+func IsSetConf(key string) bool {
+	v, subKey, ok := splitConfKey(key)
+	if !ok {
+		return false
+	}
+	return v.IsSet(subKey)
+}
+
+// 获取配置子集，如 GetConfSub("base.log") 返回 base 文件中 log 段的配置
+// 只传文件名时返回整个文件的配置，文件或配置段不存在时返回空配置
+// 返回的是配置内容的副本，修改不会影响 ViperConfMap
+func GetConfSub(key string) *viper.Viper {
+	sub := viper.New()
+	if section, err := confSection(key); err == nil {
+		sub.MergeConfigMap(section)
+	}
+	return sub
+}
+
 // 获取配置信息
 func GetStringConf(key string) string {
-	keys := strings.Split(key, ".")
-	if len(keys) < 2 {
-		return ""
-	}
-	v, ok := ViperConfMap[keys[0]]
+	v, subKey, ok := splitConfKey(key)
 	if !ok {
 		return ""
 	}
-	return v.GetString(strings.Join(keys[1:len(keys)], "."))
+	return v.GetString(subKey)
 }
 
 // 获取配置信息
 func GetIntConf(key string) int {
-	keys := strings.Split(key, ".")
-	l := len(keys)
-	if l < 2 {
+	v, subKey, ok := splitConfKey(key)
+	if !ok {
+		return 0
+	}
+	return v.GetInt(subKey)
+}
+
+// 获取配置信息
+func GetBoolConf(key string) bool {
+	v, subKey, ok := splitConfKey(key)
+	if !ok {
+		return false
+	}
+	return v.GetBool(subKey)
+}
+
+// 获取配置信息
+func GetFloat64Conf(key string) float64 {
+	v, subKey, ok := splitConfKey(key)
+	if !ok {
+		return 0
+	}
+	return v.GetFloat64(subKey)
+}
+
+// 获取配置信息，支持 "1s" "500ms" 格式，纯数字按纳秒处理
+func GetDurationConf(key string) time.Duration {
+	v, subKey, ok := splitConfKey(key)
+	if !ok {
 		return 0
 	}
-	v := ViperConfMap[keys[0]]
-	return v.GetInt(strings.Join(keys[1:l], "."))
-}
\ No newline at end of file
+	return v.GetDuration(subKey)
+}
+
+// 获取配置信息
+func GetStringSliceConf(key string) []string {
+	v, subKey, ok := splitConfKey(key)
+	if !ok {
+		return nil
+	}
+	return v.GetStringSlice(subKey)
+}
+
+// 获取配置信息
+func GetIntSliceConf(key string) []int {
+	v, subKey, ok := splitConfKey(key)
+	if !ok {
+		return nil
+	}
+	return v.GetIntSlice(subKey)
+}
+
+// 获取配置信息
+func GetStringMapConf(key string) map[string]interface{} {
+	v, subKey, ok := splitConfKey(key)
+	if !ok {
+		return nil
+	}
+	return v.GetStringMap(subKey)
+}
+
+// 获取配置信息
+func GetStringMapStringConf(key string) map[string]string {
+	v, subKey, ok := splitConfKey(key)
+	if !ok {
+		return nil
+	}
+	return v.GetStringMapString(subKey)
+}
+
+// 获取配置信息，配置项不存在时返回默认值
+func GetStringConfOrDefault(key string, def string) string {
+	if !IsSetConf(key) {
+		return def
+	}
+	return GetStringConf(key)
+}
+
+// 获取配置信息，配置项不存在时返回默认值
+func GetIntConfOrDefault(key string, def int) int {
+	if !IsSetConf(key) {
+		return def
+	}
+	return GetIntConf(key)
+}
+
+// 获取配置信息，配置项不存在时返回默认值
+func GetBoolConfOrDefault(key string, def bool) bool {
+	if !IsSetConf(key) {
+		return def
+	}
+	return GetBoolConf(key)
+}
+
+// 获取配置信息，配置项不存在时返回默认值
+func GetFloat64ConfOrDefault(key string, def float64) float64 {
+	if !IsSetConf(key) {
+		return def
+	}
+	return GetFloat64Conf(key)
+}
+
+// 获取配置信息，配置项不存在时返回默认值
+func GetDurationConfOrDefault(key string, def time.Duration) time.Duration {
+	if !IsSetConf(key) {
+		return def
+	}
+	return GetDurationConf(key)
+}
+
+// 获取配置信息，配置项不存在时返回默认值
+func GetStringSliceConfOrDefault(key string, def []string) []string {
+	if !IsSetConf(key) {
+		return def
+	}
+	return GetStringSliceConf(key)
+}
+
+// 获取配置信息，配置项不存在时返回默认值
+func GetIntSliceConfOrDefault(key string, def []int) []int {
+	if !IsSetConf(key) {
+		return def
+	}
+	return GetIntSliceConf(key)
+}
+
+// 获取配置信息，配置项不存在时返回默认值
+func GetStringMapConfOrDefault(key string, def map[string]interface{}) map[string]interface{} {
+	if !IsSetConf(key) {
+		return def
+	}
+	return GetStringMapConf(key)
+}
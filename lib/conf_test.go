@@ -0,0 +1,315 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 创建临时配置文件夹并设置 ConfEnvPath=临时文件夹/dev
+// files 的键为相对 dev 的文件名，或相对临时文件夹的路径如 common/base.toml
+func writeTestConf(t *testing.T, files map[string]string) string {
+	root, err := ioutil.TempDir("", "conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if !strings.Contains(name, "/") {
+			name = "dev/" + name
+		}
+		if err := os.MkdirAll(filepath.Dir(root+"/"+name), 0755); err != nil {
+			os.RemoveAll(root)
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(root+"/"+name, []byte(content), 0644); err != nil {
+			os.RemoveAll(root)
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(root+"/dev", 0755); err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	ConfEnvPath = root + "/dev"
+	return root
+}
+
+// 同 writeTestConf，并加载配置
+func setupTestConf(t *testing.T, files map[string]string) string {
+	root := writeTestConf(t, files)
+	if err := InitViperConf(); err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	return root
+}
+
+// 测试带类型的配置获取
+func TestTypedConf(t *testing.T) {
+	dir := setupTestConf(t, map[string]string{
+		"base.toml": `
+debug_mode = "debug"
+[http]
+addr = ":8080"
+read_timeout = "3s"
+ratio = 0.75
+keep_alive = true
+allow_ip = ["127.0.0.1", "192.168.1.1"]
+ports = [80, 443]
+[http.header]
+server = "golang_common"
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	if !GetBoolConf("base.http.keep_alive") {
+		t.Fatal("keep_alive")
+	}
+	if v := GetFloat64Conf("base.http.ratio"); v != 0.75 {
+		t.Fatalf("ratio=%v", v)
+	}
+	if v := GetDurationConf("base.http.read_timeout"); v != 3*time.Second {
+		t.Fatalf("read_timeout=%v", v)
+	}
+	if v := GetStringSliceConf("base.http.allow_ip"); len(v) != 2 || v[1] != "192.168.1.1" {
+		t.Fatalf("allow_ip=%v", v)
+	}
+	if v := GetIntSliceConf("base.http.ports"); len(v) != 2 || v[1] != 443 {
+		t.Fatalf("ports=%v", v)
+	}
+	if v := GetStringMapStringConf("base.http.header"); v["server"] != "golang_common" {
+		t.Fatalf("header=%v", v)
+	}
+
+	if !IsSetConf("base.http.addr") || IsSetConf("base.http.missing") || IsSetConf("missing.http.addr") {
+		t.Fatal("IsSetConf")
+	}
+	if v := GetIntConfOrDefault("base.http.max_header_bytes", 1<<20); v != 1<<20 {
+		t.Fatalf("max_header_bytes=%v", v)
+	}
+	if v := GetStringConfOrDefault("base.http.addr", ":80"); v != ":8080" {
+		t.Fatalf("addr=%v", v)
+	}
+	if v := GetDurationConfOrDefault("base.http.write_timeout", time.Second); v != time.Second {
+		t.Fatalf("write_timeout=%v", v)
+	}
+
+	// 文件不存在时不能 panic
+	if v := GetIntConf("missing.http.addr"); v != 0 {
+		t.Fatalf("missing=%v", v)
+	}
+
+	sub := GetConfSub("base.http")
+	if v := sub.GetString("addr"); v != ":8080" {
+		t.Fatalf("sub addr=%v", v)
+	}
+	if v := GetConfSub("base").GetString("debug_mode"); v != "debug" {
+		t.Fatalf("sub debug_mode=%v", v)
+	}
+	if GetConfSub("missing.http").IsSet("addr") || GetConfSub("base.missing").IsSet("addr") {
+		t.Fatal("missing sub")
+	}
+}
+
+// 测试配置段反序列化到结构体
+func TestUnmarshalConf(t *testing.T) {
+	dir := setupTestConf(t, map[string]string{
+		"payment.toml": `
+[gateway]
+addr = "10.0.0.1:9000"
+retry = 3
+[gateway.tls]
+on = true
+[override]
+hosts = ["x.com"]
+[override.headers]
+x-env = "prod"
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	type GatewayConf struct {
+		Addr    string        `mapstructure:"addr" default:"127.0.0.1:8080"`
+		Retry   int           `mapstructure:"retry" default:"1"`
+		Timeout time.Duration `mapstructure:"timeout" default:"3s"`
+		Hosts   []string      `mapstructure:"hosts" default:"a.com,b.com"`
+		TLS     struct {
+			On   bool   `mapstructure:"on"`
+			Cert string `mapstructure:"cert" default:"/etc/cert.pem"`
+		} `mapstructure:"tls"`
+	}
+
+	conf := GatewayConf{}
+	if err := UnmarshalConf("payment.gateway", &conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Addr != "10.0.0.1:9000" || conf.Retry != 3 || conf.Timeout != 3*time.Second {
+		t.Fatalf("conf=%+v", conf)
+	}
+	if len(conf.Hosts) != 2 || conf.Hosts[1] != "b.com" || !conf.TLS.On || conf.TLS.Cert != "/etc/cert.pem" {
+		t.Fatalf("conf=%+v", conf)
+	}
+
+	// 配置中存在的数组和 map 不与默认值合并
+	type OverrideConf struct {
+		Hosts   []string          `mapstructure:"hosts" default:"a.com,b.com"`
+		Headers map[string]string `mapstructure:"headers" default:"x-env=dev,x-app=gateway"`
+		Labels  map[string]string `mapstructure:"labels" default:"team=pay"`
+	}
+	override := OverrideConf{}
+	if err := UnmarshalConf("payment.override", &override); err != nil {
+		t.Fatal(err)
+	}
+	if len(override.Hosts) != 1 || override.Hosts[0] != "x.com" {
+		t.Fatalf("hosts=%v", override.Hosts)
+	}
+	if len(override.Headers) != 1 || override.Headers["x-env"] != "prod" {
+		t.Fatalf("headers=%v", override.Headers)
+	}
+	if len(override.Labels) != 1 || override.Labels["team"] != "pay" {
+		t.Fatalf("labels=%v", override.Labels)
+	}
+
+	if err := UnmarshalConf("payment.missing", &conf); err == nil {
+		t.Fatal("expect missing section error")
+	}
+
+	// 严格模式下未定义的配置项报错
+	type StrictConf struct {
+		Addr string `mapstructure:"addr"`
+	}
+	if err := UnmarshalConfStrict("payment.gateway", &StrictConf{}); err == nil {
+		t.Fatal("expect unknown keys error")
+	}
+	if err := UnmarshalConf("payment.gateway", &StrictConf{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testPoolConf struct {
+	Name    string `mapstructure:"name" validate:"required"`
+	MaxConn int    `mapstructure:"max_conn" validate:"min=1,max=100"`
+	Mode    string `mapstructure:"mode" validate:"oneof=master slave"`
+}
+
+func (c *testPoolConf) Validate() error {
+	if c.Mode == "slave" && c.MaxConn > 10 {
+		return errors.New("slave max_conn must not exceed 10")
+	}
+	return nil
+}
+
+// 测试配置校验汇总所有错误
+func TestValidateConf(t *testing.T) {
+	conf := &MysqlMapConf{List: map[string]*MySQLConf{
+		"default": {DataSourceName: "root@tcp(127.0.0.1:3306)/test", MaxOpenConn: 10},
+		"slave":   {MaxOpenConn: -1},
+	}}
+	err := ValidateConf("mysql_map.toml", conf)
+	errs, ok := err.(ConfErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("err=%v", err)
+	}
+	if errs[0].Key != "list.slave.data_source_name" || errs[1].Key != "list.slave.max_open_conn" {
+		t.Fatalf("err=%v", err)
+	}
+
+	base := &BaseConf{}
+	base.Log.Level = "verbose"
+	if err := ValidateConf("base.toml", base); err == nil || !strings.Contains(err.Error(), "log.log_level") {
+		t.Fatalf("err=%v", err)
+	}
+
+	dir := setupTestConf(t, map[string]string{
+		"pool.toml": `
+[a]
+max_conn = 200
+mode = "backup"
+[b]
+name = "b"
+max_conn = 20
+mode = "slave"
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	pools := map[string]*testPoolConf{}
+	err = UnmarshalConf("pool", &pools)
+	if errs, ok := err.(ConfErrors); !ok || len(errs) != 4 {
+		t.Fatalf("err=%v", err)
+	}
+	if !strings.Contains(err.Error(), "pool: b: slave max_conn must not exceed 10") {
+		t.Fatalf("err=%v", err)
+	}
+}
+
+// 测试按参数初始化可以重复调用
+func TestInitWithOptions(t *testing.T) {
+	root := writeTestConf(t, map[string]string{
+		"base.toml": "time_location = \"UTC\"\n[log]\nlog_level = \"info\"\n",
+	})
+	defer os.RemoveAll(root)
+
+	var buf bytes.Buffer
+	opts := Options{
+		ConfigPath: root + "/dev/",
+		Modules:    []string{"base"},
+		Logger:     log.New(&buf, "", 0),
+	}
+	for i := 0; i < 2; i++ {
+		if err := InitWithOptions(opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ConfEnv != "dev" || ConfBase.Log.Level != "info" || TimeLocation.String() != "UTC" {
+		t.Fatalf("env=%v base=%+v location=%v", ConfEnv, ConfBase, TimeLocation)
+	}
+	if !strings.Contains(buf.String(), "success loading config") {
+		t.Fatalf("log=%v", buf.String())
+	}
+
+	// FlagSet 中的 config 参数优先
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("config", "", "")
+	if err := fs.Parse([]string{"-config", root + "/missing/"}); err != nil {
+		t.Fatal(err)
+	}
+	opts.FlagSet = fs
+	if err := InitWithOptions(opts); err == nil {
+		t.Fatal("expect missing config path error")
+	}
+	if err := InitWithOptions(Options{Logger: opts.Logger}); err == nil {
+		t.Fatal("expect empty config path error")
+	}
+}
+
+// 测试 InitModule 先解析全局 flag 再读取 config 参数
+func TestInitModule(t *testing.T) {
+	root := writeTestConf(t, map[string]string{
+		"base.toml": "[log]\nlog_level = \"warning\"\n",
+	})
+	defer os.RemoveAll(root)
+	defer func(fs *flag.FlagSet, args []string) {
+		flag.CommandLine, os.Args = fs, args
+	}(flag.CommandLine, os.Args)
+
+	// 已定义但尚未解析的 config 参数使用命令行的值
+	flag.CommandLine = flag.NewFlagSet("app", flag.ContinueOnError)
+	flag.String("config", "", "")
+	os.Args = []string{"app", "-config", root + "/dev/"}
+	if err := InitModule("", []string{"base"}); err != nil {
+		t.Fatal(err)
+	}
+	// 恢复默认日志级别
+	defer Destroy()
+	if ConfEnv != "dev" || ConfBase.Log.Level != "warning" {
+		t.Fatalf("env=%v base=%+v", ConfEnv, ConfBase)
+	}
+}
@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// 环境变量覆盖配置项的前缀，为空时不读取环境变量
+//
+// 环境变量名规则: 前缀_文件名__配置项，层级之间用双下划线分隔，全部大写
+// 如 mysql_map 文件中的 list.default.data_source_name 对应
+// APP_MYSQL_MAP__LIST__DEFAULT__DATA_SOURCE_NAME
+// 原配置项为数组时，环境变量的值按逗号分隔
+var ConfEnvPrefix = "APP"
+
+const (
+	confEnvSep    = "__"
+	confEnvSource = "env:" // 配置项来源的前缀，见 GetConfSource
+)
+
+// 获取配置项对应的环境变量名
+// 如 ConfEnvName("base.log.log_level") 返回 APP_BASE__LOG__LOG_LEVEL
+func ConfEnvName(key string) string {
+	name := strings.ToUpper(strings.Replace(key, ".", confEnvSep, -1))
+	if ConfEnvPrefix == "" {
+		return name
+	}
+	return ConfEnvPrefix + "_" + name
+}
+
+// 获取当前配置中被环境变量覆盖的配置项，每次加载配置后重新生成
+// 返回 文件名.配置项 => 环境变量名，不包含变量值，便于调试时打印
+func ConfOverrides() map[string]string {
+	confLock.RLock()
+	defer confLock.RUnlock()
+	overrides := map[string]string{}
+	for name, sources := range confSources {
+		for key, source := range sources {
+			if strings.HasPrefix(source, confEnvSource) {
+				overrides[name+"."+key] = source[len(confEnvSource):]
+			}
+		}
+	}
+	return overrides
+}
+
+// 按配置项排序的覆盖列表，每行一个 "文件名.配置项 <= 环境变量名"
+func DumpConfOverrides() []string {
+	overrides := ConfOverrides()
+	lines := make([]string, 0, len(overrides))
+	for key, env := range overrides {
+		lines = append(lines, key+" <= "+env)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// 用环境变量覆盖 name 文件中的配置项
+// 返回被覆盖的 配置项 => 环境变量名
+func applyConfEnv(name string, v *viper.Viper) map[string]string {
+	overrides := map[string]string{}
+	if ConfEnvPrefix == "" || name == "" {
+		return overrides
+	}
+	filePrefix := ConfEnvName(name) + confEnvSep
+	for _, kv := range os.Environ() {
+		idx := strings.Index(kv, "=")
+		if idx <= 0 || !strings.HasPrefix(kv[:idx], filePrefix) {
+			continue
+		}
+		env, value := kv[:idx], kv[idx+1:]
+		key := strings.ToLower(strings.Replace(env[len(filePrefix):], confEnvSep, ".", -1))
+		if key == "" {
+			continue
+		}
+		switch v.Get(key).(type) {
+		case []interface{}, []string:
+			v.Set(key, splitConfEnv(value))
+		default:
+			v.Set(key, value)
+		}
+		overrides[key] = env
+	}
+	return overrides
+}
+
+func splitConfEnv(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	items := strings.Split(value, ",")
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+	return items
+}
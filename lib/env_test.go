@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"os"
+	"testing"
+)
+
+// 测试环境变量覆盖配置项
+func TestConfEnvOverride(t *testing.T) {
+	root := writeTestConf(t, map[string]string{
+		"mysql_map.toml": `
+[list.default]
+data_source_name = "root:123456@tcp(127.0.0.1:3306)/test"
+max_open_conn = 20
+`,
+		"redis_map.toml": `
+[list.default]
+proxy_list = ["127.0.0.1:6379"]
+`,
+	})
+	defer os.RemoveAll(root)
+
+	if name := ConfEnvName("mysql_map.list.default.data_source_name"); name != "APP_MYSQL_MAP__LIST__DEFAULT__DATA_SOURCE_NAME" {
+		t.Fatalf("env name=%v", name)
+	}
+	os.Setenv("APP_MYSQL_MAP__LIST__DEFAULT__DATA_SOURCE_NAME", "app:secret@tcp(db:3306)/app")
+	os.Setenv("APP_MYSQL_MAP__LIST__DEFAULT__MAX_OPEN_CONN", "50")
+	os.Setenv("APP_REDIS_MAP__LIST__DEFAULT__PROXY_LIST", "10.0.0.1:6379, 10.0.0.2:6379")
+	defer os.Unsetenv("APP_MYSQL_MAP__LIST__DEFAULT__DATA_SOURCE_NAME")
+	defer os.Unsetenv("APP_MYSQL_MAP__LIST__DEFAULT__MAX_OPEN_CONN")
+	defer os.Unsetenv("APP_REDIS_MAP__LIST__DEFAULT__PROXY_LIST")
+
+	if err := InitViperConf(); err != nil {
+		t.Fatal(err)
+	}
+	if v := GetStringConf("mysql_map.list.default.data_source_name"); v != "app:secret@tcp(db:3306)/app" {
+		t.Fatalf("data_source_name=%v", v)
+	}
+	if v := GetIntConf("mysql_map.list.default.max_open_conn"); v != 50 {
+		t.Fatalf("max_open_conn=%v", v)
+	}
+
+	mysqlConf := &MysqlMapConf{}
+	if err := ParseConfig(GetConfPath("mysql_map"), mysqlConf); err != nil {
+		t.Fatal(err)
+	}
+	if c := mysqlConf.List["default"]; c == nil || c.DataSourceName != "app:secret@tcp(db:3306)/app" || c.MaxOpenConn != 50 {
+		t.Fatalf("mysql conf=%+v", c)
+	}
+	redisConf := &RedisMapConf{}
+	if err := ParseConfig(GetConfPath("redis_map"), redisConf); err != nil {
+		t.Fatal(err)
+	}
+	if c := redisConf.List["default"]; c == nil || len(c.ProxyList) != 2 || c.ProxyList[1] != "10.0.0.2:6379" {
+		t.Fatalf("redis conf=%+v", c)
+	}
+
+	overrides := ConfOverrides()
+	if overrides["mysql_map.list.default.max_open_conn"] != "APP_MYSQL_MAP__LIST__DEFAULT__MAX_OPEN_CONN" {
+		t.Fatalf("overrides=%v", overrides)
+	}
+
+	// 环境变量取消或前缀变化后重新加载，不再保留旧的覆盖记录
+	os.Unsetenv("APP_MYSQL_MAP__LIST__DEFAULT__MAX_OPEN_CONN")
+	if err := InitViperConf(); err != nil {
+		t.Fatal(err)
+	}
+	overrides = ConfOverrides()
+	if _, ok := overrides["mysql_map.list.default.max_open_conn"]; ok || len(overrides) != 2 {
+		t.Fatalf("overrides=%v", overrides)
+	}
+	defer func(prefix string) { ConfEnvPrefix = prefix }(ConfEnvPrefix)
+	ConfEnvPrefix = "OTHER"
+	if err := InitViperConf(); err != nil {
+		t.Fatal(err)
+	}
+	if overrides = ConfOverrides(); len(overrides) != 0 {
+		t.Fatalf("overrides=%v", overrides)
+	}
+}
+
+// 测试配置加密值解密
+func TestConfSecret(t *testing.T) {
+	key, err := GenConfSecretKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(ConfSecretKeyEnv, key)
+	defer os.Unsetenv(ConfSecretKeyEnv)
+	rawKey, err := LoadConfSecretKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsn, err := EncryptConfValue("root:123456@tcp(127.0.0.1:3306)/test", rawKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, err := EncryptConfValue("redis-secret", rawKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := setupTestConf(t, map[string]string{
+		"mysql_map.toml": "[list.default]\ndata_source_name = \"" + dsn + "\"\n",
+		"redis_map.toml": "[list.default]\nproxy_list = [\"127.0.0.1:6379\"]\npassword = \"" + password + "\"\n",
+	})
+	defer os.RemoveAll(root)
+
+	if v := GetStringConf("mysql_map.list.default.data_source_name"); v != "root:123456@tcp(127.0.0.1:3306)/test" {
+		t.Fatalf("data_source_name=%v", v)
+	}
+	conf := &RedisMapConf{}
+	if err := ParseConfig(GetConfPath("redis_map"), conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.List["default"].Password != "redis-secret" {
+		t.Fatalf("password=%v", conf.List["default"].Password)
+	}
+
+	// 未配置密钥或密钥错误时加载失败
+	os.Unsetenv(ConfSecretKeyEnv)
+	if err := InitViperConf(); err == nil {
+		t.Fatal("expect missing secret key error")
+	}
+	otherKey, _ := GenConfSecretKey()
+	os.Setenv(ConfSecretKeyEnv, otherKey)
+	if err := InitViperConf(); err == nil {
+		t.Fatal("expect decrypt error")
+	}
+}
+
+// 测试环境变量覆盖和解密后的值中的 ${ 不做变量替换
+func TestConfLiteralValues(t *testing.T) {
+	key, err := GenConfSecretKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(ConfSecretKeyEnv, key)
+	defer os.Unsetenv(ConfSecretKeyEnv)
+	rawKey, err := LoadConfSecretKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsn, err := EncryptConfValue("root:p${ass@tcp(127.0.0.1:3306)/test", rawKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("APP_APP__TOKEN", "x${y}")
+	defer os.Unsetenv("APP_APP__TOKEN")
+
+	root := setupTestConf(t, map[string]string{
+		"app.toml":       "token = \"\"\nheader = \"Bearer ${app.token}\"\n",
+		"mysql_map.toml": "[list.default]\ndata_source_name = \"" + dsn + "\"\n",
+	})
+	defer os.RemoveAll(root)
+
+	if v := GetStringConf("app.token"); v != "x${y}" {
+		t.Fatalf("token=%v", v)
+	}
+	// 引用方仍然替换
+	if v := GetStringConf("app.header"); v != "Bearer x${y}" {
+		t.Fatalf("header=%v", v)
+	}
+	if v := GetStringConf("mysql_map.list.default.data_source_name"); v != "root:p${ass@tcp(127.0.0.1:3306)/test" {
+		t.Fatalf("data_source_name=%v", v)
+	}
+	conf := &MysqlMapConf{}
+	if err := ParseConfig(GetConfPath("mysql_map"), conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.List["default"].DataSourceName != "root:p${ass@tcp(127.0.0.1:3306)/test" {
+		t.Fatalf("data_source_name=%v", conf.List["default"].DataSourceName)
+	}
+}
@@ -6,12 +6,28 @@ import (
 	"os"
 	"io/ioutil"
 	"bytes"
+	"path/filepath"
 	"github.com/spf13/viper"
 )
 
 var ConfEnvPath string  // 配置文件夹
 var ConfEnv string 		// 配置环境名 比如：dev prod test
 
+// 支持的配置文件扩展名及对应的 viper 配置类型
+var confFileTypes = map[string]string{
+	"toml":       "toml",
+	"yaml":       "yaml",
+	"yml":        "yaml",
+	"json":       "json",
+	"ini":        "ini",
+	"properties": "properties",
+	"props":      "properties",
+	"prop":       "properties",
+}
+
+// 扩展名查找顺序
+var confFileExts = []string{"toml", "yaml", "yml", "json", "ini", "properties", "props", "prop"}
+
 // 解析配置文件目录: 将配置文件夹和配置环境赋给全局变量
 // 
 // 配置文件必须放到文件夹内
@@ -29,25 +45,224 @@ func GetConfEnv() string{
 	return ConfEnv
 }
 
+// 公共配置层的文件夹名
+const ConfCommonLayer = "common"
+
+// 获取配置层文件夹，按合并顺序排列，后面的覆盖前面的
+//
+// 如 ConfEnvPath=conf/dev 时依次为:
+//	conf/common     各环境共用的默认配置，可选
+//	conf/dev        环境配置
+//	conf/dev.local  本地开发配置，可选，不应提交到代码库
+func ConfLayers() []string {
+	if ConfEnvPath == "" {
+		return nil
+	}
+	layers := []string{}
+	common := filepath.Join(filepath.Dir(ConfEnvPath), ConfCommonLayer)
+	if filepath.Clean(common) != filepath.Clean(ConfEnvPath) && isConfDir(common) {
+		layers = append(layers, common)
+	}
+	layers = append(layers, ConfEnvPath)
+	if local := ConfEnvPath + ".local"; isConfDir(local) {
+		layers = append(layers, local)
+	}
+	return layers
+}
+
+func isConfDir(dir string) bool {
+	fi, err := os.Stat(dir)
+	return err == nil && fi.IsDir()
+}
+
+// 判断 path 是否位于某个配置层文件夹内
+func isConfLayerPath(path string) bool {
+	dir := filepath.Clean(filepath.Dir(path))
+	for _, layer := range ConfLayers() {
+		if filepath.Clean(layer) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// 获取配置文件路径
+// 按扩展名查找配置文件，找不到或存在同名冲突文件时返回空字符串
 func GetConfPath(fileName string) string {
-	return ConfEnvPath + "/" + fileName + ".toml"
+	path, err := ResolveConfPath(fileName)
+	if err != nil {
+		return ""
+	}
+	return path
 }
 
+// 获取配置文件路径
+// 如 ResolveConfPath("base") 依次查找 base.toml base.yaml base.yml base.json ...
+// 优先返回 ConfEnvPath 下的文件，其次是本地配置层、公共配置层
+// 同一配置层内同一文件名存在多个格式的文件时返回错误
+func ResolveConfPath(fileName string) (string, error) {
+	layers := ConfLayers()
+	found := ""
+	for i := len(layers) - 1; i >= 0; i-- {
+		files, err := findConfFiles(layers[i], fileName)
+		if err != nil {
+			return "", err
+		}
+		if len(files) > 0 && (found == "" || layers[i] == ConfEnvPath) {
+			found = layers[i] + "/" + files[0]
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("config file [%v] not found in %v", fileName, layers)
+	}
+	return found, nil
+}
+
+// 查找 dir 下文件名为 name 的配置文件
+// 存在多个时返回冲突错误
+func findConfFiles(dir string, name string) ([]string, error) {
+	var files []string
+	for _, ext := range confFileExts {
+		fileName := name + "." + ext
+		if fi, err := os.Stat(dir + "/" + fileName); err == nil && !fi.IsDir() {
+			files = append(files, fileName)
+		}
+	}
+	if len(files) > 1 {
+		return files, fmt.Errorf("config file [%v] conflict in [%v]. files=%v", name, dir, files)
+	}
+	return files, nil
+}
+
+// 根据扩展名获取配置类型
+func GetConfType(path string) (string, bool) {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	confType, ok := confFileTypes[ext]
+	return confType, ok
+}
+
+// 将配置文件反序列化到结构体
+// path 位于配置层文件夹内时，使用各配置层合并后的结果，见 ConfLayers
+// ENC(...) 格式的加密值在反序列化前解密，见 ConfSecretKeyEnv
+// ${...} 变量在反序列化前替换，见 confInterpolator
 func ParseConfig(path string, conf interface{}) error {
+	var v *viper.Viper
+	if isConfLayerPath(path) {
+		lv, _, literal, err := loadViperConf(confFileName(filepath.Base(path)))
+		if err != nil {
+			return err
+		}
+		if lv == nil {
+			return fmt.Errorf("open config path [%v] fail. err=file not found", path)
+		}
+		v = lv
+		if err := interpolateLoadedConf(confFileName(filepath.Base(path)), v, literal); err != nil {
+			return err
+		}
+	} else {
+		fv, err := readViperConf(path)
+		if err != nil {
+			return err
+		}
+		name := confFileName(filepath.Base(path))
+		overrides := applyConfEnv(name, fv)
+		decrypted, err := decryptConf(name, fv)
+		if err != nil {
+			return err
+		}
+		if err := interpolateLoadedConf(name, fv, confLiteralKeys(overrides, decrypted)); err != nil {
+			return err
+		}
+		v = fv
+	}
+
+	if err := v.Unmarshal(conf); err != nil {
+		return fmt.Errorf("Parse config fail. path=%v, err=%v", path, err)
+	}
+	return ValidateConf(path, conf)
+}
+
+// 读取单个配置文件，按扩展名识别格式
+// 支持 include = ["common/db.toml"] 引入其他配置文件，见 confIncludeKey
+func readViperConf(path string) (*viper.Viper, error) {
+	return readViperConfInclude(path, nil)
+}
+
+// 引入其他配置文件的配置项
+// 被引入的文件按顺序合并，当前文件的配置项覆盖被引入的配置项
+// 相对路径先相对当前文件所在文件夹查找，找不到时相对配置根目录（ConfEnvPath 的上级目录）查找
+const confIncludeKey = "include"
+
+func readViperConfInclude(path string, stack []string) (*viper.Viper, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		absPath = path
+	}
+	for _, p := range stack {
+		if p == absPath {
+			return nil, fmt.Errorf("config include cycle. %v", strings.Join(append(stack, absPath), " -> "))
+		}
+	}
+
+	confType, ok := GetConfType(path)
+	if !ok {
+		return nil, fmt.Errorf("unsupported config type. path=%v", path)
+	}
 	file, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("open config path [%v] fail. err=%v", path, err)
+		return nil, fmt.Errorf("open config path [%v] fail. err=%v", path, err)
 	}
+	defer file.Close()
 	data, err := ioutil.ReadAll(file)
 	if err != nil {
-		return fmt.Errorf("read config path [%v] fail. err=%v", path, err)
+		return nil, fmt.Errorf("read config path [%v] fail. err=%v", path, err)
 	}
 
 	v := viper.New()
-	v.SetConfigType("toml")
-	v.ReadConfig(bytes.NewBuffer(data))
-	if err := v.Unmarshal(conf); err != nil {
-		return fmt.Errorf("Parse config fail. config=%v, err=%v", string(data), err)
+	v.SetConfigType(confType)
+	if err := v.ReadConfig(bytes.NewBuffer(data)); err != nil {
+		return nil, fmt.Errorf("Parse config fail. path=%v, err=%v", path, err)
 	}
-	return nil
-}
\ No newline at end of file
+	if !v.IsSet(confIncludeKey) {
+		return v, nil
+	}
+
+	includeStack := make([]string, len(stack), len(stack)+1)
+	copy(includeStack, stack)
+	includeStack = append(includeStack, absPath)
+	merged := viper.New()
+	for _, include := range v.GetStringSlice(confIncludeKey) {
+		iv, err := readViperConfInclude(confIncludePath(path, include), includeStack)
+		if err != nil {
+			return nil, fmt.Errorf("config [%v] include [%v] fail. %v", path, include, err)
+		}
+		if err := merged.MergeConfigMap(iv.AllSettings()); err != nil {
+			return nil, fmt.Errorf("config [%v] include [%v] fail. %v", path, include, err)
+		}
+	}
+	settings := v.AllSettings()
+	delete(settings, confIncludeKey)
+	if err := merged.MergeConfigMap(settings); err != nil {
+		return nil, fmt.Errorf("Parse config fail. path=%v, err=%v", path, err)
+	}
+	return merged, nil
+}
+
+func confIncludePath(path string, include string) string {
+	if filepath.IsAbs(include) {
+		return include
+	}
+	local := filepath.Join(filepath.Dir(path), include)
+	if isConfFile(local) || ConfEnvPath == "" {
+		return local
+	}
+	if root := filepath.Join(filepath.Dir(ConfEnvPath), include); isConfFile(root) {
+		return root
+	}
+	return local
+}
+
+func isConfFile(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && !fi.IsDir()
+}
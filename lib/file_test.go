@@ -0,0 +1,184 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// 测试按扩展名识别配置格式
+func TestConfFileTypes(t *testing.T) {
+	root := setupTestConf(t, map[string]string{
+		"base.toml":      "[http]\naddr = \":8080\"\n",
+		"redis_map.yaml": "list:\n  default:\n    proxy_list: [\"127.0.0.1:6379\"]\n    db: 2\n",
+		"mysql_map.json": "{\"list\": {\"default\": {\"max_open_conn\": 20}}}",
+		"feature.ini":    "[switch]\non = true\n",
+		"README.md":      "# not a config file",
+	})
+	defer os.RemoveAll(root)
+	dir := ConfEnvPath
+
+	if v := GetStringConf("base.http.addr"); v != ":8080" {
+		t.Fatalf("base.http.addr=%v", v)
+	}
+	if v := GetIntConf("redis_map.list.default.db"); v != 2 {
+		t.Fatalf("redis_map.list.default.db=%v", v)
+	}
+	if v := GetIntConf("mysql_map.list.default.max_open_conn"); v != 20 {
+		t.Fatalf("mysql_map.list.default.max_open_conn=%v", v)
+	}
+	if v := GetStringConf("feature.switch.on"); v != "true" {
+		t.Fatalf("feature.switch.on=%v", v)
+	}
+
+	if path := GetConfPath("redis_map"); path != dir+"/redis_map.yaml" {
+		t.Fatalf("redis_map path=%v", path)
+	}
+	conf := &RedisMapConf{}
+	if err := ParseConfig(GetConfPath("redis_map"), conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.List["default"] == nil || conf.List["default"].Db != 2 {
+		t.Fatalf("redis_map=%+v", conf.List)
+	}
+
+	// 只去掉最后一个扩展名，备份文件不与原文件冲突
+	if err := ioutil.WriteFile(dir+"/base.bak.toml", []byte("[http]\naddr = \":7070\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitViperConf(); err != nil {
+		t.Fatal(err)
+	}
+	if v := GetStringConf("base.http.addr"); v != ":8080" {
+		t.Fatalf("base.http.addr=%v", v)
+	}
+	os.Remove(dir + "/base.bak.toml")
+
+	// 同名不同格式的文件视为冲突
+	if err := ioutil.WriteFile(dir+"/base.yml", []byte("http:\n  addr: \":9090\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveConfPath("base"); err == nil {
+		t.Fatal("expect conflict error")
+	}
+	if err := InitViperConf(); err == nil {
+		t.Fatal("expect conflict error")
+	}
+}
+
+// 测试公共配置、环境配置、本地配置逐层合并
+func TestConfLayers(t *testing.T) {
+	root := setupTestConf(t, map[string]string{
+		"common/base.yaml":    "log:\n  log_level: info\n  file_writer:\n    \"on\": true\nhttp:\n  addr: \":80\"\n",
+		"common/cache.toml":   "ttl = 60\n",
+		"base.toml":           "[http]\naddr = \":8080\"\nread_timeout = 10\n",
+		"dev.local/base.toml": "[log]\nlog_level = \"trace\"\n",
+	})
+	defer os.RemoveAll(root)
+
+	if layers := ConfLayers(); len(layers) != 3 || layers[0] != root+"/common" || layers[2] != root+"/dev.local" {
+		t.Fatalf("layers=%v", layers)
+	}
+	if v := GetStringConf("base.log.log_level"); v != "trace" {
+		t.Fatalf("log_level=%v", v)
+	}
+	if !GetBoolConf("base.log.file_writer.on") || GetStringConf("base.http.addr") != ":8080" || GetIntConf("base.http.read_timeout") != 10 {
+		t.Fatal("merged base conf")
+	}
+	if v := GetIntConf("cache.ttl"); v != 60 {
+		t.Fatalf("cache.ttl=%v", v)
+	}
+
+	if s := GetConfSource("base.log.log_level"); s != root+"/dev.local" {
+		t.Fatalf("log_level source=%v", s)
+	}
+	if s := GetConfSource("base.http.addr"); s != root+"/dev" {
+		t.Fatalf("addr source=%v", s)
+	}
+	if s := GetConfSource("base.log.file_writer.on"); s != root+"/common" {
+		t.Fatalf("file_writer.on source=%v", s)
+	}
+	if s := GetConfSource("base.http.missing"); s != "" {
+		t.Fatalf("missing source=%v", s)
+	}
+
+	if path := GetConfPath("cache"); path != root+"/common/cache.toml" {
+		t.Fatalf("cache path=%v", path)
+	}
+	conf := &BaseConf{}
+	if err := ParseConfig(GetConfPath("base"), conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Log.Level != "trace" || !conf.Log.FW.On {
+		t.Fatalf("base conf=%+v", conf)
+	}
+}
+
+// 测试变量替换和 include 引入
+func TestConfInterpolate(t *testing.T) {
+	os.Setenv("TEST_DB_HOST", "10.0.0.8")
+	defer os.Unsetenv("TEST_DB_HOST")
+
+	root := setupTestConf(t, map[string]string{
+		"common/db.toml": "[db]\nport = 3306\nuser = \"root\"\n",
+		"base.toml": `
+include = ["common/db.toml"]
+[db]
+host = "${TEST_DB_HOST}"
+name = "${TEST_DB_NAME:-app}"
+[http]
+addr = ":${base.http.port}"
+port = 8080
+tip = "$${TEST_DB_HOST}"
+`,
+		"mysql_map.toml": `
+[list.default]
+data_source_name = "${base.db.user}@tcp(${base.db.host}:${base.db.port})/${base.db.name}"
+`,
+	})
+	defer os.RemoveAll(root)
+
+	if v := GetStringConf("base.db.user"); v != "root" {
+		t.Fatalf("included user=%v", v)
+	}
+	if IsSetConf("base.include") {
+		t.Fatal("include key should be removed")
+	}
+	if v := GetStringConf("base.http.addr"); v != ":8080" {
+		t.Fatalf("addr=%v", v)
+	}
+	if v := GetStringConf("base.http.tip"); v != "${TEST_DB_HOST}" {
+		t.Fatalf("tip=%v", v)
+	}
+	dsn := "root@tcp(10.0.0.8:3306)/app"
+	if v := GetStringConf("mysql_map.list.default.data_source_name"); v != dsn {
+		t.Fatalf("dsn=%v", v)
+	}
+	conf := &MysqlMapConf{}
+	if err := ParseConfig(GetConfPath("mysql_map"), conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.List["default"].DataSourceName != dsn {
+		t.Fatalf("parsed dsn=%v", conf.List["default"].DataSourceName)
+	}
+
+	// 引用不存在、循环引用、循环 include 都返回错误
+	cases := map[string]string{
+		"missing.toml": "addr = \"${base.http.missing}\"\n",
+		"cycle.toml":   "a = \"${cycle.b}\"\nb = \"${cycle.a}\"\n",
+		"loop.toml":    "include = [\"loop.toml\"]\n",
+	}
+	for name, content := range cases {
+		path := ConfEnvPath + "/" + name
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := InitViperConf(); err == nil {
+			t.Fatalf("%v: expect error", name)
+		} else if !strings.Contains(err.Error(), confFileName(name)) {
+			t.Fatalf("%v: err=%v", name, err)
+		}
+		os.Remove(path)
+	}
+}
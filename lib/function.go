@@ -11,6 +11,8 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"math/rand"
+	"errors"
+	"context"
 	dlog "github.com/yaolixiao/golang_common/log"
 )
 
@@ -27,17 +29,80 @@ func Init(configPath string) error {
 }
 
 // 模块初始化
+// 在全局 flag 中定义 -config 参数并解析，然后按 InitWithOptions 初始化，配置文件夹为空时退出进程
+// 作为库使用或在测试中调用时请使用 InitWithOptions
 func InitModule(configPath string, modules []string) error {
-	conf := flag.String("config", configPath, "input config file like ./conf/dev/")
-	flag.Parse()
-	if *conf == "" {
+	if flag.Lookup("config") == nil {
+		flag.String("config", configPath, "input config file like ./conf/dev/")
+	}
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+	opts := Options{ConfigPath: configPath, Modules: modules, FlagSet: flag.CommandLine}
+	if opts.configPath() == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
+	return InitWithOptions(opts)
+}
+
+// 初始化参数
+type Options struct {
+	// 配置文件夹，如 ./conf/dev/
+	ConfigPath string
+	// 需要初始化的模块，为空时初始化 base redis mysql，见 RegisterModule
+	Modules []string
+	// 不为空且定义了 config 参数时，参数值优先于 ConfigPath
+	// 只读取参数值，不会定义参数或调用 Parse
+	FlagSet *flag.FlagSet
+	// 启动过程的日志输出，为空时输出到标准错误
+	Logger *log.Logger
+	// 模块初始化失败时的处理策略，未指定的模块使用 DefaultPolicy
+	Policies map[string]ModulePolicy
+	// 默认为 ModuleRequired，任一模块初始化失败即中止启动
+	DefaultPolicy ModulePolicy
+}
 
-	log.Println("========================================")
-	log.Printf("[INFO] config=%s\n", *conf)
-	log.Printf("[INFO] %s\n", "start loading config.")
+// FlagSet 中 config 参数的值优先于 ConfigPath
+func (opts Options) configPath() string {
+	if opts.FlagSet != nil {
+		if f := opts.FlagSet.Lookup("config"); f != nil && f.Value.String() != "" {
+			return f.Value.String()
+		}
+	}
+	return opts.ConfigPath
+}
+
+func (opts Options) modulePolicy(name string) ModulePolicy {
+	if policy, ok := opts.Policies[name]; ok {
+		return policy
+	}
+	return opts.DefaultPolicy
+}
+
+// 按参数初始化模块
+// 不使用全局 flag，出错时返回错误而不是退出进程，可以重复调用
+// 模块初始化失败按 Options.Policies 处理，中止启动时关闭已初始化的模块并返回 *InitError
+func InitWithOptions(opts Options) error {
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	modules := opts.Modules
+	if len(modules) == 0 {
+		modules = []string{"base", "redis", "mysql"}
+	}
+	conf := opts.configPath()
+	if conf == "" {
+		return errors.New("init fail. empty config path")
+	}
+
+	// 重复初始化时先关闭之前初始化的模块
+	closeModules(context.Background(), logger.Printf)
+
+	logger.Println("========================================")
+	logger.Printf("[INFO] config=%s\n", conf)
+	logger.Printf("[INFO] %s\n", "start loading config.")
 
 	// 优先设置IP，便于日志打印
 	ips := getLocationIPs()
@@ -46,7 +111,7 @@ func InitModule(configPath string, modules []string) error {
 	}
 
 	// 解析配置文件目录
-	if err := ParseConfPath(*conf); err != nil {
+	if err := ParseConfPath(conf); err != nil {
 		return err
 	}
 
@@ -54,43 +119,90 @@ func InitModule(configPath string, modules []string) error {
 	if err := InitViperConf(); err != nil {
 		return err
 	}
-
-	// 加载base配置
-	if InArrayString("base", modules) {
-		if err := InitBaseConf(GetConfPath("base")); err != nil {
-			fmt.Printf("[ERROR] %s %s\n", time.Now().Format(TimeFormat), "InitBaseConf:" + err.Error())
-		}
+	for _, line := range DumpConfOverrides() {
+		logger.Printf("[INFO] config override %s\n", line)
 	}
 
-	// 加载redis配置
-	if InArrayString("redis", modules) {
-		if err := InitRedisConf(GetConfPath("redis_map")); err != nil {
-			fmt.Printf("[ERROR] %s %s\n", time.Now().Format(TimeFormat), "InitRedisConf:" + err.Error())
-		}
+	// 按依赖顺序初始化模块
+	sorted, err := sortModules(modules)
+	if err != nil {
+		return err
 	}
+	ctx := context.Background()
+	failures := []*ModuleError{}
+	failed := map[string]bool{}
+	inited := map[string]bool{}
+	degraded := []string{}
+	abort := func(failure *ModuleError) error {
+		failures = append(failures, failure)
+		logger.Printf("[ERROR] %s %s\n", time.Now().Format(TimeFormat), "init abort. "+failure.Error())
+		closeModules(ctx, logger.Printf)
+		setDegradedModules(nil)
+		return &InitError{Failures: failures}
+	}
+	for _, m := range sorted {
+		policy := opts.modulePolicy(m.Name())
+		startTime := time.Now()
+		var err error
+		for _, dep := range m.DependsOn() {
+			if failed[dep] {
+				err = fmt.Errorf("dependency [%v] init fail", dep)
+				break
+			}
+		}
+		if err == nil {
+			err = m.Init(ctx)
+		}
+		if err == nil {
+			inited[m.Name()] = true
+			addInitedModule(m)
+			logger.Printf("[INFO] init module [%s] success. proc_time=%fs\n", m.Name(), time.Since(startTime).Seconds())
+			continue
+		}
 
-	// 加载mysql配置
-	if InArrayString("mysql", modules) {
-		if err := InitDBPool(GetConfPath("mysql_map")); err != nil {
-			fmt.Printf("[ERROR] %s %s\n", time.Now().Format(TimeFormat), " InitDBPool:" + err.Error())
+		// 释放初始化失败的模块已经打开的部分资源
+		if cerr := m.Close(ctx); cerr != nil {
+			logger.Printf("[WARN] %s %s\n", time.Now().Format(TimeFormat), "close module "+m.Name()+":"+cerr.Error())
+		}
+		failure := &ModuleError{Name: m.Name(), Policy: policy, Err: err}
+		failed[m.Name()] = true
+		switch policy {
+		case ModuleOptional:
+			failures = append(failures, failure)
+			logger.Printf("[WARN] %s %s\n", time.Now().Format(TimeFormat), "InitModule "+failure.Error())
+		case ModuleDegraded:
+			failures = append(failures, failure)
+			degraded = append(degraded, m.Name())
+			logger.Printf("[ERROR] %s %s\n", time.Now().Format(TimeFormat), "InitModule "+failure.Error())
+		default:
+			return abort(failure)
 		}
 	}
+	setDegradedModules(degraded)
 
-	// 设置时区
-	if location, err := time.LoadLocation(ConfBase.TimeLocation); err != nil {
-		return err
-	} else {
+	// 设置时区，未初始化base时使用本地时区
+	TimeLocation = time.Local
+	if inited["base"] && ConfBase != nil {
+		location, err := time.LoadLocation(ConfBase.TimeLocation)
+		if err != nil {
+			return abort(&ModuleError{Name: "base", Policy: opts.modulePolicy("base"), Err: err})
+		}
 		TimeLocation = location
 	}
 
-	log.Println("[INFO] success loading config.")
+	logger.Println("[INFO] success loading config.")
 	return nil
 }
 
 // 公共销毁函数
+// 按初始化的逆序关闭模块，关闭数据库连接池，最后刷新并关闭日志
+// 需要等待信号退出时使用 WaitForShutdown
 func Destroy() {
 	log.Printf("[INFO] %s\n", " start destroy resources.")
-	// CloseDB() // todo
+	StopWatchConf()
+	closeModules(context.Background(), log.Printf)
+	CloseDB()
+	CloseRedis()
 	dlog.Close()
 	log.Printf("[INFO] %s\n", " success destroy resources.")
 }
@@ -131,6 +243,23 @@ func NewTrace() *TraceContext {
 	return trace
 }
 
+type traceContextKey struct{}
+
+// 将 trace 保存到 ctx 中
+func WithTrace(ctx context.Context, trace *TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, trace)
+}
+
+// 获取 ctx 中的 trace，不存在时新建
+func GetTrace(ctx context.Context) *TraceContext {
+	if ctx != nil {
+		if trace, ok := ctx.Value(traceContextKey{}).(*TraceContext); ok && trace != nil {
+			return trace
+		}
+	}
+	return NewTrace()
+}
+
 func NewSpanId() string {
 	timestamp := uint32(time.Now().Unix())
 	ipToLong := binary.BigEndian.Uint32(LocalIP.To4())
@@ -0,0 +1,193 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// 配置值中的变量替换
+//
+//	${ENV_VAR}            环境变量，未设置时报错
+//	${ENV_VAR:-default}   环境变量，未设置或为空时使用默认值
+//	${file.key}           其他配置项，如 ${mysql_map.list.default.host}
+//	${file.key:-default}  配置项不存在或为空时使用默认值
+//	$${...}               原样输出 ${...}
+//
+// 变量名包含 . 时视为配置项引用，否则为环境变量
+// 来自环境变量覆盖和 ENC(...) 解密的值按原样使用，不做替换
+// 被引用的文件热加载后，引用方不会重新计算
+type confInterpolator struct {
+	confs     map[string]*viper.Viper
+	pending   map[string]bool // 需要替换的文件，其余文件视为已替换
+	done      map[string]bool
+	resolving map[string]bool
+	literal   map[string]bool // 不替换的配置项，文件名.配置项
+	stack     []string
+}
+
+// 替换 names 配置中的变量，引用的配置从 confs 中查找
+// literal 中的配置项（文件名.配置项）不替换，可以被其他配置项引用
+func interpolateConf(confs map[string]*viper.Viper, names []string, literal map[string]bool) error {
+	ci := &confInterpolator{
+		confs:     confs,
+		literal:   literal,
+		pending:   map[string]bool{},
+		done:      map[string]bool{},
+		resolving: map[string]bool{},
+	}
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		ci.pending[name] = true
+	}
+	for _, name := range sorted {
+		v := confs[name]
+		if v == nil {
+			continue
+		}
+		keys := v.AllKeys()
+		sort.Strings(keys)
+		for _, key := range keys {
+			if _, err := ci.resolveKey(name, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 替换单个配置项中的变量并返回替换后的值
+func (ci *confInterpolator) resolveKey(name string, key string) (interface{}, error) {
+	v := ci.confs[name]
+	fullKey := name + "." + key
+	if ci.done[fullKey] || !ci.pending[name] || ci.literal[fullKey] {
+		return v.Get(key), nil
+	}
+	if ci.resolving[fullKey] {
+		return nil, fmt.Errorf("config [%v] interpolation cycle. %v", ci.stack[0], strings.Join(append(ci.stack, fullKey), " -> "))
+	}
+	ci.resolving[fullKey] = true
+	ci.stack = append(ci.stack, fullKey)
+	defer func() {
+		delete(ci.resolving, fullKey)
+		ci.stack = ci.stack[:len(ci.stack)-1]
+	}()
+
+	switch value := v.Get(key).(type) {
+	case string:
+		if strings.Contains(value, "${") {
+			expanded, err := ci.expand(fullKey, value)
+			if err != nil {
+				return nil, err
+			}
+			v.Set(key, expanded)
+		}
+	case []interface{}:
+		items := make([]interface{}, len(value))
+		changed := false
+		for i, item := range value {
+			items[i] = item
+			if s, ok := item.(string); ok && strings.Contains(s, "${") {
+				expanded, err := ci.expand(fmt.Sprintf("%s[%d]", fullKey, i), s)
+				if err != nil {
+					return nil, err
+				}
+				items[i] = expanded
+				changed = true
+			}
+		}
+		if changed {
+			v.Set(key, items)
+		}
+	}
+	ci.done[fullKey] = true
+	return v.Get(key), nil
+}
+
+// 替换字符串中的 ${...}
+func (ci *confInterpolator) expand(fullKey string, s string) (string, error) {
+	var b strings.Builder
+	for {
+		idx := strings.Index(s, "${")
+		if idx < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if idx > 0 && s[idx-1] == '$' {
+			b.WriteString(s[:idx-1])
+			b.WriteString("${")
+			s = s[idx+2:]
+			continue
+		}
+		end := strings.Index(s[idx:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("config [%v] unclosed variable in %q", fullKey, s)
+		}
+		b.WriteString(s[:idx])
+		value, err := ci.lookup(fullKey, s[idx+2:idx+end])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+		s = s[idx+end+1:]
+	}
+}
+
+// 查找变量的值
+func (ci *confInterpolator) lookup(fullKey string, expr string) (string, error) {
+	name, def, hasDef := expr, "", false
+	if idx := strings.Index(expr, ":-"); idx >= 0 {
+		name, def, hasDef = expr[:idx], expr[idx+2:], true
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("config [%v] empty variable ${%v}", fullKey, expr)
+	}
+
+	// 环境变量
+	if !strings.Contains(name, ".") {
+		if value, ok := os.LookupEnv(name); ok && value != "" {
+			return value, nil
+		}
+		if hasDef {
+			return def, nil
+		}
+		return "", fmt.Errorf("config [%v] env [%v] not set", fullKey, name)
+	}
+
+	// 配置项引用
+	keys := strings.SplitN(name, ".", 2)
+	if v := ci.confs[keys[0]]; v != nil && v.IsSet(keys[1]) {
+		value, err := ci.resolveKey(keys[0], strings.ToLower(keys[1]))
+		if err != nil {
+			return "", err
+		}
+		if s := fmt.Sprint(value); s != "" {
+			return s, nil
+		}
+	}
+	if hasDef {
+		return def, nil
+	}
+	return "", fmt.Errorf("config [%v] reference [%v] not found", fullKey, name)
+}
+
+// 替换 name 配置中的变量，引用的其他配置从当前 ViperConfMap 中查找，literal 中的配置项不替换
+func interpolateLoadedConf(name string, v *viper.Viper, literal map[string]bool) error {
+	confLock.RLock()
+	confs := make(map[string]*viper.Viper, len(ViperConfMap)+1)
+	for k, c := range ViperConfMap {
+		confs[k] = c
+	}
+	confLock.RUnlock()
+	confs[name] = v
+	literals := make(map[string]bool, len(literal))
+	for key := range literal {
+		literals[name+"."+key] = true
+	}
+	return interpolateConf(confs, []string{name}, literals)
+}
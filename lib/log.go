@@ -12,6 +12,8 @@ const (
 	DLTagMySqlFailed   = "_com_mysql_failure"
 	DLTagRedisFailed   = "_com_redis_failure"
 	DLTagMySqlSuccess  = "_com_mysql_success"
+	DLTagMySqlTimeout  = "_com_mysql_timeout"
+	DLTagMySqlSlow     = "_com_mysql_slow"
 	DLTagRedisSuccess  = "_com_redis_success"
 	DLTagThriftFailed  = "_com_thrift_failure"
 	DLTagThriftSuccess = "_com_thrift_success"
@@ -20,6 +22,8 @@ const (
 	DLTagTCPFailed     = "_com_tcp_failure"
 	DLTagRequestIn     = "_com_request_in"
 	DLTagRequestOut    = "_com_request_out"
+	DLTagCacheHit      = "_com_cache_hit"
+	DLTagCacheMiss     = "_com_cache_miss"
 )
 
 const (
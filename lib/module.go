@@ -0,0 +1,253 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// 可初始化的资源模块，如 base redis mysql，或业务自定义的 kafka、http client 等
+// 通过 RegisterModule 注册后，可以在 InitModule、InitWithOptions 的 modules 中按名字引用
+type Module interface {
+	// 模块名，全局唯一
+	Name() string
+	// 依赖的模块名，依赖的模块会先初始化、后关闭，未在 modules 中指定时自动初始化
+	DependsOn() []string
+	// 初始化
+	Init(ctx context.Context) error
+	// 关闭，Destroy 时按初始化的逆序调用
+	Close(ctx context.Context) error
+}
+
+type funcModule struct {
+	name      string
+	dependsOn []string
+	init      func(ctx context.Context) error
+	close     func(ctx context.Context) error
+}
+
+// 用函数创建模块，close 可以为 nil
+func NewModule(name string, dependsOn []string, init func(ctx context.Context) error, close func(ctx context.Context) error) Module {
+	return &funcModule{name: name, dependsOn: dependsOn, init: init, close: close}
+}
+
+func (m *funcModule) Name() string {
+	return m.name
+}
+
+func (m *funcModule) DependsOn() []string {
+	return m.dependsOn
+}
+
+func (m *funcModule) Init(ctx context.Context) error {
+	if m.init == nil {
+		return nil
+	}
+	return m.init(ctx)
+}
+
+func (m *funcModule) Close(ctx context.Context) error {
+	if m.close == nil {
+		return nil
+	}
+	return m.close(ctx)
+}
+
+var (
+	moduleLock   sync.Mutex
+	moduleMap    = map[string]Module{}
+	moduleInited []Module // 已初始化的模块，按初始化顺序
+)
+
+// 注册模块，同名模块会被覆盖
+func RegisterModule(m Module) {
+	moduleLock.Lock()
+	defer moduleLock.Unlock()
+	moduleMap[m.Name()] = m
+}
+
+// 获取已注册的模块
+func GetModule(name string) (Module, bool) {
+	moduleLock.Lock()
+	defer moduleLock.Unlock()
+	m, ok := moduleMap[name]
+	return m, ok
+}
+
+// 按依赖关系排序模块，被依赖的在前
+// 没有依赖关系的模块保持 names 中的顺序，依赖的模块未在 names 中时自动加入
+func sortModules(names []string) ([]Module, error) {
+	moduleLock.Lock()
+	defer moduleLock.Unlock()
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	sorted := []Module{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("module dependency cycle. %v", strings.Join(append(path, name), " -> "))
+		}
+		m, ok := moduleMap[name]
+		if !ok {
+			if len(path) > 0 {
+				return fmt.Errorf("module [%v] not registered. required by [%v]", name, path[len(path)-1])
+			}
+			return fmt.Errorf("module [%v] not registered", name)
+		}
+		state[name] = visiting
+		next := append(append([]string{}, path...), name)
+		for _, dep := range m.DependsOn() {
+			if err := visit(dep, next); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		sorted = append(sorted, m)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// 记录已初始化的模块
+func addInitedModule(m Module) {
+	moduleLock.Lock()
+	defer moduleLock.Unlock()
+	moduleInited = append(moduleInited, m)
+}
+
+// 按初始化的逆序关闭已初始化的模块，返回关闭失败的错误
+func closeModules(ctx context.Context, logf func(format string, v ...interface{})) []error {
+	moduleLock.Lock()
+	inited := moduleInited
+	moduleInited = nil
+	moduleLock.Unlock()
+
+	var errs []error
+	for i := len(inited) - 1; i >= 0; i-- {
+		if err := inited[i].Close(ctx); err != nil {
+			err = fmt.Errorf("close module [%v] fail. err=%v", inited[i].Name(), err)
+			logf("[ERROR] %s\n", err.Error())
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// 内置模块
+func init() {
+	RegisterModule(NewModule("base", nil, func(ctx context.Context) error {
+		path, err := ResolveConfPath("base")
+		if err != nil {
+			return err
+		}
+		return InitBaseConf(path)
+	}, func(ctx context.Context) error {
+		CloseBaseLog()
+		return nil
+	}))
+
+	RegisterModule(NewModule("redis", nil, func(ctx context.Context) error {
+		path, err := ResolveConfPath("redis_map")
+		if err != nil {
+			return err
+		}
+		if err := InitRedisConf(path); err != nil {
+			return err
+		}
+		return InitRedisPool()
+	}, func(ctx context.Context) error {
+		return CloseRedis()
+	}))
+
+	RegisterModule(NewModule("mysql", nil, func(ctx context.Context) error {
+		path, err := ResolveConfPath("mysql_map")
+		if err != nil {
+			return err
+		}
+		return InitDBPool(path)
+	}, func(ctx context.Context) error {
+		return CloseDB()
+	}))
+}
+
+// 模块初始化失败时的处理策略
+type ModulePolicy int
+
+const (
+	// 初始化失败时中止启动，关闭已初始化的模块并返回 *InitError
+	ModuleRequired ModulePolicy = iota
+	// 初始化失败时记录警告，继续启动
+	ModuleOptional
+	// 初始化失败时记录错误，继续启动，模块标记为降级，见 IsModuleDegraded
+	ModuleDegraded
+)
+
+func (p ModulePolicy) String() string {
+	switch p {
+	case ModuleRequired:
+		return "required"
+	case ModuleOptional:
+		return "optional"
+	case ModuleDegraded:
+		return "degraded"
+	}
+	return fmt.Sprintf("policy(%d)", int(p))
+}
+
+// 单个模块初始化失败
+type ModuleError struct {
+	Name   string
+	Policy ModulePolicy
+	Err    error
+}
+
+func (e *ModuleError) Error() string {
+	return fmt.Sprintf("%v(%v): %v", e.Name, e.Policy, e.Err)
+}
+
+// 初始化失败，包含启动过程中所有失败的模块
+type InitError struct {
+	Failures []*ModuleError
+}
+
+func (e *InitError) Error() string {
+	msgs := make([]string, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		msgs = append(msgs, f.Error())
+	}
+	return fmt.Sprintf("init fail. %d module(s) failed: %s", len(e.Failures), strings.Join(msgs, "; "))
+}
+
+var moduleDegraded []string // 初始化失败且策略为 ModuleDegraded 的模块
+
+// 获取降级运行的模块
+func DegradedModules() []string {
+	moduleLock.Lock()
+	defer moduleLock.Unlock()
+	return append([]string{}, moduleDegraded...)
+}
+
+// 判断模块是否降级运行
+func IsModuleDegraded(name string) bool {
+	return InArrayString(name, DegradedModules())
+}
+
+func setDegradedModules(names []string) {
+	moduleLock.Lock()
+	defer moduleLock.Unlock()
+	moduleDegraded = names
+}
@@ -0,0 +1,216 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dlog "github.com/yaolixiao/golang_common/log"
+)
+
+// 测试模块按依赖顺序初始化、逆序关闭
+func TestModuleOrder(t *testing.T) {
+	root := writeTestConf(t, map[string]string{
+		"base.toml": "time_location = \"UTC\"\n",
+	})
+	defer os.RemoveAll(root)
+
+	var events []string
+	newTestModule := func(name string, deps []string, initErr error) Module {
+		return NewModule(name, deps, func(ctx context.Context) error {
+			events = append(events, "init "+name)
+			return initErr
+		}, func(ctx context.Context) error {
+			events = append(events, "close "+name)
+			return nil
+		})
+	}
+	RegisterModule(newTestModule("test_kafka", []string{"base", "test_cache"}, nil))
+	RegisterModule(newTestModule("test_cache", []string{"test_http"}, nil))
+	RegisterModule(newTestModule("test_http", nil, nil))
+	RegisterModule(newTestModule("test_broken", nil, errors.New("broken")))
+
+	opts := Options{
+		ConfigPath: root + "/dev/",
+		Modules:    []string{"test_kafka", "test_broken"},
+		Policies:   map[string]ModulePolicy{"test_broken": ModuleOptional},
+	}
+	if err := InitWithOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	Destroy()
+
+	expect := []string{
+		"init test_http", "init test_cache", "init test_kafka", "init test_broken", "close test_broken",
+		"close test_kafka", "close test_cache", "close test_http",
+	}
+	if !reflect.DeepEqual(events, expect) {
+		t.Fatalf("events=%v", events)
+	}
+
+	RegisterModule(newTestModule("test_a", []string{"test_b"}, nil))
+	RegisterModule(newTestModule("test_b", []string{"test_a"}, nil))
+	if _, err := sortModules([]string{"test_a"}); err == nil || !strings.Contains(err.Error(), "test_a -> test_b -> test_a") {
+		t.Fatalf("err=%v", err)
+	}
+	if _, err := sortModules([]string{"test_missing"}); err == nil {
+		t.Fatal("expect not registered error")
+	}
+}
+
+// 测试模块初始化失败的处理策略
+func TestModulePolicy(t *testing.T) {
+	root := writeTestConf(t, map[string]string{
+		"base.toml": "time_location = \"UTC\"\n",
+	})
+	defer os.RemoveAll(root)
+
+	var events []string
+	newTestModule := func(name string, deps []string, initErr error) Module {
+		return NewModule(name, deps, func(ctx context.Context) error {
+			events = append(events, "init "+name)
+			return initErr
+		}, func(ctx context.Context) error {
+			events = append(events, "close "+name)
+			return nil
+		})
+	}
+	RegisterModule(newTestModule("test_ok", nil, nil))
+	RegisterModule(newTestModule("test_cache_down", nil, errors.New("cache down")))
+	RegisterModule(newTestModule("test_search_down", nil, errors.New("search down")))
+	RegisterModule(newTestModule("test_on_search", []string{"test_search_down"}, nil))
+	RegisterModule(newTestModule("test_db_down", nil, errors.New("db down")))
+
+	// 降级模块及依赖它的模块失败后继续启动
+	opts := Options{
+		ConfigPath: root + "/dev/",
+		Modules:    []string{"base", "test_ok", "test_cache_down", "test_on_search"},
+		Policies: map[string]ModulePolicy{
+			"test_cache_down":  ModuleOptional,
+			"test_search_down": ModuleDegraded,
+			"test_on_search":   ModuleDegraded,
+		},
+	}
+	if err := InitWithOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(DegradedModules(), []string{"test_search_down", "test_on_search"}) || IsModuleDegraded("test_ok") {
+		t.Fatalf("degraded=%v", DegradedModules())
+	}
+	if TimeLocation.String() != "UTC" {
+		t.Fatalf("location=%v", TimeLocation)
+	}
+
+	// 必需模块失败时中止启动，关闭已初始化的模块
+	events = nil
+	opts.Modules = append(opts.Modules, "test_db_down")
+	err := InitWithOptions(opts)
+	initErr, ok := err.(*InitError)
+	if !ok || len(initErr.Failures) != 4 || initErr.Failures[3].Name != "test_db_down" || initErr.Failures[3].Policy != ModuleRequired {
+		t.Fatalf("err=%v", err)
+	}
+	if !strings.Contains(err.Error(), "test_on_search(degraded): dependency [test_search_down] init fail") {
+		t.Fatalf("err=%v", err)
+	}
+	if events[len(events)-2] != "close test_db_down" || events[len(events)-1] != "close test_ok" {
+		t.Fatalf("events=%v", events)
+	}
+	if len(DegradedModules()) != 0 {
+		t.Fatalf("degraded=%v", DegradedModules())
+	}
+}
+
+type testFlushWriter struct {
+	flushed int32
+}
+
+func (w *testFlushWriter) Init() error {
+	return nil
+}
+
+func (w *testFlushWriter) Write(r *dlog.Record) error {
+	return nil
+}
+
+func (w *testFlushWriter) Flush() error {
+	atomic.StoreInt32(&w.flushed, 1)
+	return nil
+}
+
+// 测试中止启动时关闭 base 模块设置的日志
+func TestModuleAbortCloseLog(t *testing.T) {
+	root := writeTestConf(t, map[string]string{
+		"base.toml": "time_location = \"UTC\"\n",
+	})
+	defer os.RemoveAll(root)
+
+	w := &testFlushWriter{}
+	RegisterModule(NewModule("test_log_writer", []string{"base"}, func(ctx context.Context) error {
+		dlog.Register(w)
+		return nil
+	}, nil))
+	RegisterModule(NewModule("test_abort", []string{"test_log_writer"}, func(ctx context.Context) error {
+		return errors.New("abort")
+	}, nil))
+	err := InitWithOptions(Options{ConfigPath: root + "/dev/", Modules: []string{"base", "test_abort"}})
+	if _, ok := err.(*InitError); !ok {
+		t.Fatalf("err=%v", err)
+	}
+	if atomic.LoadInt32(&w.flushed) != 1 || baseLogSetup {
+		t.Fatal("base log not closed")
+	}
+}
+
+// 测试退出清理函数逆序执行及超时报告
+func TestShutdown(t *testing.T) {
+	var events []string
+	var lock sync.Mutex
+	record := func(event string) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+	}
+	RegisterShutdownHook("http", 0, func(ctx context.Context) error {
+		record("http")
+		return nil
+	})
+	RegisterShutdownHook("consumer", 50*time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		time.Sleep(100 * time.Millisecond)
+		record("consumer")
+		return nil
+	})
+	RegisterShutdownHook("flush", 0, func(ctx context.Context) error {
+		record("flush")
+		return errors.New("flush fail")
+	})
+
+	startTime := time.Now()
+	err := Shutdown(time.Second)
+	if time.Since(startTime) > 500*time.Millisecond {
+		t.Fatalf("shutdown waited too long. %v", time.Since(startTime))
+	}
+	shutdownErr, ok := err.(*ShutdownError)
+	if !ok || len(shutdownErr.Failures) != 2 {
+		t.Fatalf("err=%v", err)
+	}
+	if shutdownErr.Failures[0].Name != "flush" || shutdownErr.Failures[1].Name != "consumer" || !shutdownErr.Failures[1].Timeout {
+		t.Fatalf("err=%v", err)
+	}
+	lock.Lock()
+	if !reflect.DeepEqual(events, []string{"flush", "http"}) {
+		t.Fatalf("events=%v", events)
+	}
+	lock.Unlock()
+
+	// 清理函数只执行一次
+	if err := Shutdown(time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"fmt"
 	"time"
 	"github.com/yaolixiao/gorm"
@@ -24,52 +25,56 @@ func InitDBPool(path string) error {
 		fmt.Printf("[WARN] %s %s\n", time.Now().Format(TimeFormat), " empty mysql config.")
 	}
 
-	DBMapPool = map[string]*sql.DB{}
-	GORMMapPool = map[string]*gorm.DB{}
+	dbPools := map[string]*sql.DB{}
+	gormPools := map[string]*gorm.DB{}
+	routePools := map[string]*DBPool{}
+	gormRoutePools := map[string]*gorm.DB{}
+	closePools := func() {
+		for _, dbpool := range routePools {
+			dbpool.Close()
+		}
+	}
 	for confName, DBConf := range DbConfMap.List {
-		// 普通的DB方式
-		db, err := sql.Open("mysql", DBConf.DataSourceName)
+		// 读写分离的DB方式，读语句发送到从库
+		route, err := openDBPool(confName, DBConf)
 		if err != nil {
+			closePools()
 			return err
 		}
-		db.SetMaxOpenConns(DBConf.MaxOpenConn)
-		db.SetMaxIdleConns(DBConf.MaxIdleConn)
-		db.SetConnMaxLifetime(time.Duration(DBConf.MaxConnLifeTime) * time.Second)
-		// 检查数据库连接是否仍然有效
-		err = db.Ping()
+		routePools[confName] = route
+
+		// 普通的DB方式，使用主库
+		db := route.Master()
+		dbPools[confName] = db
+
+		// gorm的DB方式，与普通的DB方式共用连接池
+		redact, err := newDBRedactPolicy(DBConf)
 		if err != nil {
+			closePools()
 			return err
 		}
-
-		// gorm的DB方式
-		dbgorm, err := gorm.Open("mysql", DBConf.DataSourceName)
+		logConf := &dbLogConf{slow: newDBSlowLog(confName, DBConf, route), redact: redact}
+		gormPools[confName], err = newGormDB(db, logConf)
 		if err != nil {
+			closePools()
 			return err
 		}
-
-		// gorm默认的结构体映射是复数形式，比如你的博客表为blog，对应的结构体名就会是blogs
-		// 若表名为多个单词，对应的model结构体名字必须是驼峰式，首字母也必须大写
-		// 配置 DB.SingularTable(true) 以实现结构体名为非复数形式, 禁用表名复数
-		// 如果只是部分表需要使用源表名，请在实体类中声明TableName的构造函数
-		// func (实体名) TableName() string {
-		// 		return "数据库表名"
-		// }
-		dbgorm.SingularTable(true)
-		err = dbgorm.DB().Ping()
+		gormRoutePools[confName], err = newGormDB(route, logConf)
 		if err != nil {
+			closePools()
 			return err
 		}
-
-		dbgorm.LogMode(true)
-		dbgorm.LogCtx(true)
-		dbgorm.SetLogger(&MysqlGormLogger{Trace: NewTrace()})
-		dbgorm.DB().SetMaxIdleConns(DBConf.MaxIdleConn)
-		dbgorm.DB().SetMaxOpenConns(DBConf.MaxOpenConn)
-		dbgorm.DB().SetConnMaxLifetime(time.Duration(DBConf.MaxConnLifeTime) * time.Second)
-		DBMapPool[confName] = db
-		GORMMapPool[confName] = dbgorm
+		timeout := time.Duration(DBConf.QueryTimeout) * time.Millisecond
+		setDBQueryTimeout(db, timeout)
+		setDBQueryTimeout(route, timeout)
+		setDBLogConf(db, logConf)
+		setDBLogConf(route, logConf)
 	}
-	
+	DBMapPool = dbPools
+	GORMMapPool = gormPools
+	DBRouteMapPool = routePools
+	GORMRouteMapPool = gormRoutePools
+
 	//手动配置连接
 	if dbpool, err := GetDBPool("default"); err == nil {
 		DBDefaultPool = dbpool
@@ -80,6 +85,28 @@ func InitDBPool(path string) error {
 	return nil
 }
 
+// db 为 *DBPool 时读语句发送到从库，此时 DB() 返回 nil
+func newGormDB(db gorm.SQLCommon, logConf *dbLogConf) (*gorm.DB, error) {
+	dbgorm, err := gorm.Open("mysql", db)
+	if err != nil {
+		return nil, err
+	}
+
+	// gorm默认的结构体映射是复数形式，比如你的博客表为blog，对应的结构体名就会是blogs
+	// 若表名为多个单词，对应的model结构体名字必须是驼峰式，首字母也必须大写
+	// 配置 DB.SingularTable(true) 以实现结构体名为非复数形式, 禁用表名复数
+	// 如果只是部分表需要使用源表名，请在实体类中声明TableName的构造函数
+	// func (实体名) TableName() string {
+	// 		return "数据库表名"
+	// }
+	dbgorm.SingularTable(true)
+	dbgorm.LogMode(true)
+	dbgorm.LogCtx(true)
+	dbgorm.SetLogger(&MysqlGormLogger{Trace: NewTrace(), logConf: logConf})
+	return dbgorm, nil
+}
+
+// 主库连接池
 func GetDBPool(name string) (*sql.DB, error) {
 	if dbpool, ok := DBMapPool[name]; ok {
 		return dbpool, nil
@@ -87,6 +114,7 @@ func GetDBPool(name string) (*sql.DB, error) {
 	return nil, errors.New("get pool error")
 }
 
+// 主库连接池
 func GetGormPool(name string) (*gorm.DB, error) {
 	if dbpool, ok := GORMMapPool[name]; ok {
 		return dbpool, nil
@@ -94,51 +122,218 @@ func GetGormPool(name string) (*gorm.DB, error) {
 	return nil, errors.New("get pool error")
 }
 
-func CloseDB() error {
-	for _, dbpool := range DBMapPool {
-		dbpool.Close()
+// 读写分离的连接池，读语句发送到健康的从库，写语句和事务发送到主库，没有配置 slaves 时都发送到主库
+func GetDBRoutePool(name string) (*DBPool, error) {
+	if dbpool, ok := DBRouteMapPool[name]; ok {
+		return dbpool, nil
 	}
-	for _, dbpool := range GORMMapPool {
+	return nil, errors.New("get pool error")
+}
+
+// 读写分离的 gorm，同 GetDBRoutePool，DB() 返回 nil，需要设置连接池时使用 GetGormPool
+func GetGormRoutePool(name string) (*gorm.DB, error) {
+	if dbpool, ok := GORMRouteMapPool[name]; ok {
+		return dbpool, nil
+	}
+	return nil, errors.New("get pool error")
+}
+
+// 关闭所有连接池，可重复调用
+func CloseDB() error {
+	// 普通的DB方式和 gorm 与读写分离的连接池共用主库
+	for _, dbpool := range DBRouteMapPool {
 		dbpool.Close()
 	}
+	DBMapPool = map[string]*sql.DB{}
+	GORMMapPool = map[string]*gorm.DB{}
+	DBRouteMapPool = map[string]*DBPool{}
+	GORMRouteMapPool = map[string]*gorm.DB{}
+	resetDBQueryTimeout()
+	resetDBLogConf()
+	DBDefaultPool = nil
+	GORMDefaultPool = nil
 	return nil
 }
 
-func DBPoolLogQuery(trace *TraceContext, sqlDb *sql.DB, query string, args ...interface{}) (*sql.Rows, error) {
+// *sql.DB 和 *sql.Tx 共有的方法，DBPoolLog* 可以在连接池或事务上执行
+type DBExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+func DBPoolLogQuery(trace *TraceContext, sqlDb DBExecutor, query string, args ...interface{}) (*sql.Rows, error) {
 	startExecTime := time.Now()
 	rows, err := sqlDb.Query(query, args...)
-	endExecTime := time.Now()
-	if err != nil {
-		Log.TagError(trace, "_com_mysql_success", map[string]interface{}{
-			"sql":       query,
-			"bind":      args,
-			"proc_time": fmt.Sprintf("%f", endExecTime.Sub(startExecTime).Seconds()),
-		})
+	logDBQuery(trace, sqlDb, query, args, startExecTime, -1, err)
+	return rows, err
+}
+
+func DBPoolLogExec(trace *TraceContext, sqlDb DBExecutor, query string, args ...interface{}) (sql.Result, error) {
+	startExecTime := time.Now()
+	result, err := sqlDb.Exec(query, args...)
+	var affected int64 = -1
+	if err == nil {
+		affected, _ = result.RowsAffected()
+	}
+	logDBQuery(trace, sqlDb, query, args, startExecTime, affected, err)
+	return result, err
+}
+
+// 查询单行，Scan 时记录日志，sql.ErrNoRows 不视为失败
+func DBPoolLogQueryRow(trace *TraceContext, sqlDb DBExecutor, query string, args ...interface{}) *DBLogRow {
+	startExecTime := time.Now()
+	row := sqlDb.QueryRow(query, args...)
+	return &DBLogRow{row: row, trace: trace, db: sqlDb, query: query, args: args, startExecTime: startExecTime}
+}
+
+type DBLogRow struct {
+	row           *sql.Row
+	trace         *TraceContext
+	db            interface{} // 执行 sql 的连接池或事务，用于慢查询检测
+	query         string
+	args          []interface{}
+	startExecTime time.Time
+	ctx           context.Context    // DBPoolLogQueryRowContext 的 ctx，用于区分超时
+	cancel        context.CancelFunc // Scan 后释放 query_timeout
+}
+
+func (r *DBLogRow) Scan(dest ...interface{}) error {
+	err := r.row.Scan(dest...)
+	if r.cancel != nil {
+		r.cancel()
+	}
+	if err == sql.ErrNoRows {
+		logDBQuery(r.trace, r.db, r.query, r.args, r.startExecTime, 0, nil)
+	} else if r.ctx != nil {
+		logDBQueryContext(r.ctx, r.trace, r.db, r.query, r.args, r.startExecTime, -1, err)
 	} else {
-		Log.TagInfo(trace, "_com_mysql_success", map[string]interface{}{
-			"sql":       query,
-			"bind":      args,
-			"proc_time": fmt.Sprintf("%f", endExecTime.Sub(startExecTime).Seconds()),
-		})
+		logDBQuery(r.trace, r.db, r.query, r.args, r.startExecTime, -1, err)
+	}
+	return err
+}
+
+// 预编译语句，返回的 DBLogStmt 每次执行都记录日志
+func DBPoolLogPrepare(trace *TraceContext, sqlDb DBExecutor, query string) (*DBLogStmt, error) {
+	startExecTime := time.Now()
+	stmt, err := sqlDb.Prepare(query)
+	logDBQuery(trace, sqlDb, query, nil, startExecTime, -1, err)
+	if err != nil {
+		return nil, err
+	}
+	return &DBLogStmt{Stmt: stmt, trace: trace, db: sqlDb, query: query}, nil
+}
+
+type DBLogStmt struct {
+	*sql.Stmt
+	trace *TraceContext
+	db    interface{}
+	query string
+}
+
+func (s *DBLogStmt) Exec(args ...interface{}) (sql.Result, error) {
+	startExecTime := time.Now()
+	result, err := s.Stmt.Exec(args...)
+	var affected int64 = -1
+	if err == nil {
+		affected, _ = result.RowsAffected()
 	}
+	logDBQuery(s.trace, s.db, s.query, args, startExecTime, affected, err)
+	return result, err
+}
+
+func (s *DBLogStmt) Query(args ...interface{}) (*sql.Rows, error) {
+	startExecTime := time.Now()
+	rows, err := s.Stmt.Query(args...)
+	logDBQuery(s.trace, s.db, s.query, args, startExecTime, -1, err)
 	return rows, err
 }
 
+func (s *DBLogStmt) QueryRow(args ...interface{}) *DBLogRow {
+	startExecTime := time.Now()
+	row := s.Stmt.QueryRow(args...)
+	return &DBLogRow{row: row, trace: s.trace, db: s.db, query: s.query, args: args, startExecTime: startExecTime}
+}
+
+// 可以开启事务的连接池，*sql.DB 和 *DBPool 都实现了该接口，*DBPool 的事务使用主库
+type DBTxBeginner interface {
+	Begin() (*sql.Tx, error)
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// 在事务中执行 fn，fn 返回 nil 时提交，返回错误或 panic 时回滚，panic 回滚后继续抛出
+func DBPoolTx(trace *TraceContext, sqlDb DBTxBeginner, fn func(tx *sql.Tx) error) (err error) {
+	startExecTime := time.Now()
+	tx, err := sqlDb.Begin()
+	logDBQuery(trace, sqlDb, "BEGIN", nil, startExecTime, -1, err)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			startExecTime := time.Now()
+			rbErr := tx.Rollback()
+			logDBQuery(trace, tx, "ROLLBACK", nil, startExecTime, -1, rbErr)
+			panic(p)
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		startExecTime := time.Now()
+		rbErr := tx.Rollback()
+		logDBQuery(trace, tx, "ROLLBACK", nil, startExecTime, -1, rbErr)
+		return err
+	}
+	startExecTime = time.Now()
+	err = tx.Commit()
+	logDBQuery(trace, tx, "COMMIT", nil, startExecTime, -1, err)
+	return err
+}
+
+// 按 DLTagMySqlSuccess/DLTagMySqlFailed 记录 sql 日志，affected 小于 0 时不记录影响行数
+// 超过 db 的 slow_threshold_ms 时按 DLTagMySqlSlow 记录，bind 按 db 的脱敏规则处理
+func logDBQuery(trace *TraceContext, db interface{}, query string, args []interface{}, startExecTime time.Time, affected int64, err error) {
+	logDBQueryTag(trace, db, DLTagMySqlFailed, query, args, startExecTime, affected, err)
+}
+
+// 失败时使用 failTag 记录
+func logDBQueryTag(trace *TraceContext, db interface{}, failTag string, query string, args []interface{}, startExecTime time.Time, affected int64, err error) {
+	if trace == nil {
+		trace = NewTrace()
+	}
+	procTime := time.Since(startExecTime)
+	logConf := getDBLogConf(db)
+	fields := map[string]interface{}{
+		"sql":       query,
+		"bind":      logConf.redact.redact(query, args),
+		"proc_time": fmt.Sprintf("%f", procTime.Seconds()),
+	}
+	if affected >= 0 {
+		fields["affected_row"] = affected
+	}
+	if err != nil {
+		fields["err"] = err
+		Log.TagError(trace, failTag, fields)
+	} else if logConf.slow.isSlow(procTime) {
+		logConf.slow.log(trace, query, args, procTime, fields)
+	} else {
+		Log.TagInfo(trace, DLTagMySqlSuccess, fields)
+	}
+}
+
 //mysql日志打印类
 // Logger default logger
 type MysqlGormLogger struct {
 	gorm.Logger
-	Trace *TraceContext
+	Trace   *TraceContext
+	logConf *dbLogConf // 连接池的慢查询和脱敏配置
 }
 
 // Print format & print log
 func (logger *MysqlGormLogger) Print(values ...interface{}) {
-	message := logger.LogFormatter(values...)
-	if message["level"] == "sql" {
-		Log.TagInfo(logger.Trace, "_com_mysql_success", message)
-	} else {
-		Log.TagInfo(logger.Trace, "_com_mysql_failure", message)
-	}
+	logger.print(logger.Trace, values...)
 }
 
 // LogCtx(true) 时会执行改方法
@@ -148,12 +343,24 @@ func (logger *MysqlGormLogger) CtxPrint(s *gorm.DB,values ...interface{}) {
 	if ok{
 		trace=ctx.(*TraceContext)
 	}
+	logger.print(trace, values...)
+}
+
+// 超过 slow_threshold_ms 的 sql 按 DLTagMySqlSlow 记录
+func (logger *MysqlGormLogger) print(trace *TraceContext, values ...interface{}) {
 	message := logger.LogFormatter(values...)
-	if message["level"] == "sql" {
-		Log.TagInfo(trace, "_com_mysql_success", message)
-	} else {
+	if message["level"] != "sql" {
 		Log.TagInfo(trace, "_com_mysql_failure", message)
+		return
+	}
+	slow := logger.getLogConf().slow
+	if procTime, ok := values[2].(time.Duration); ok && slow.isSlow(procTime) {
+		query, _ := values[3].(string)
+		args, _ := values[4].([]interface{})
+		slow.log(trace, query, args, procTime, message)
+		return
 	}
+	Log.TagInfo(trace, "_com_mysql_success", message)
 }
 
 func (logger *MysqlGormLogger) LogFormatter(values ...interface{}) (messages map[string]interface{}) {
@@ -173,8 +380,12 @@ func (logger *MysqlGormLogger) LogFormatter(values ...interface{}) (messages map
 			//messages = append(messages, fmt.Sprintf("%.2fms", float64(values[2].(time.Duration).Nanoseconds() / 1e4) / 100.0))
 			messages["proc_time"] = fmt.Sprintf("%fs", values[2].(time.Duration).Seconds())
 			// sql
+			redact := logger.getLogConf().redact
+			if redact != nil {
+				messages["sql_template"] = values[3]
+			}
 
-			for _, value := range values[4].([]interface{}) {
+			for _, value := range redact.redact(values[3].(string), values[4].([]interface{})) {
 				indirectValue := reflect.Indirect(reflect.ValueOf(value))
 				if indirectValue.IsValid() {
 					value = indirectValue.Interface()
@@ -228,6 +439,13 @@ func (logger *MysqlGormLogger) LogFormatter(values ...interface{}) (messages map
 	return
 }
 
+func (logger *MysqlGormLogger) getLogConf() *dbLogConf {
+	if logger.logConf == nil {
+		return emptyDBLogConf
+	}
+	return logger.logConf
+}
+
 func (logger *MysqlGormLogger) NowFunc() time.Time {
 	return time.Now()
 }
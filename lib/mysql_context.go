@@ -0,0 +1,196 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// *sql.DB 和 *sql.Tx 共有的带 context 的方法
+type DBContextExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+var (
+	dbTimeoutLock   sync.RWMutex
+	dbQueryTimeouts = map[DBContextExecutor]time.Duration{} // 连接池 => query_timeout
+)
+
+func setDBQueryTimeout(db DBContextExecutor, timeout time.Duration) {
+	dbTimeoutLock.Lock()
+	defer dbTimeoutLock.Unlock()
+	if timeout > 0 {
+		dbQueryTimeouts[db] = timeout
+	} else {
+		delete(dbQueryTimeouts, db)
+	}
+}
+
+func resetDBQueryTimeout() {
+	dbTimeoutLock.Lock()
+	defer dbTimeoutLock.Unlock()
+	dbQueryTimeouts = map[DBContextExecutor]time.Duration{}
+}
+
+// 连接池的 query_timeout，事务和单个连接使用所属连接池的配置
+func getDBQueryTimeout(db DBContextExecutor) time.Duration {
+	dbTimeoutLock.RLock()
+	defer dbTimeoutLock.RUnlock()
+	if timeout, ok := dbQueryTimeouts[db]; ok {
+		return timeout
+	}
+	if owner := dbOwnerAddr(db); owner != 0 {
+		for key, timeout := range dbQueryTimeouts {
+			if dbAddr(key) == owner {
+				return timeout
+			}
+		}
+	}
+	return 0
+}
+
+// *sql.Tx 和 *sql.Conn 所属 *sql.DB 的地址，sql 包没有导出，通过反射读取，其他类型返回 0
+// 事务不一定通过 DBPoolTx 开启，如 DBDefaultPool.Begin()，按所属连接池查找配置
+func dbOwnerAddr(db interface{}) uintptr {
+	switch db.(type) {
+	case *sql.Tx, *sql.Conn:
+	default:
+		return 0
+	}
+	v := reflect.ValueOf(db)
+	if v.IsNil() {
+		return 0
+	}
+	owner := v.Elem().FieldByName("db")
+	if !owner.IsValid() || owner.Kind() != reflect.Ptr {
+		return 0
+	}
+	return owner.Pointer()
+}
+
+// *sql.DB 的地址，其他类型返回 0
+func dbAddr(db interface{}) uintptr {
+	if d, ok := db.(*sql.DB); ok {
+		return reflect.ValueOf(d).Pointer()
+	}
+	return 0
+}
+
+// 按 query_timeout 为单条 sql 设置超时，ctx 已有更早的截止时间时以 ctx 为准
+func dbQueryContext(ctx context.Context, db DBContextExecutor) (context.Context, context.CancelFunc) {
+	timeout := getDBQueryTimeout(db)
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// 超时失败时按 DLTagMySqlTimeout 记录，其余同 logDBQuery
+func logDBQueryContext(ctx context.Context, trace *TraceContext, db interface{}, query string, args []interface{}, startExecTime time.Time, affected int64, err error) {
+	failTag := DLTagMySqlFailed
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		failTag = DLTagMySqlTimeout
+	}
+	logDBQueryTag(trace, db, failTag, query, args, startExecTime, affected, err)
+}
+
+// 同 DBPoolLogQuery，ctx 结束或超过连接池的 query_timeout 时取消查询，trace 从 ctx 中获取
+// sqlDb 为事务或 *sql.Conn 时使用所属连接池的 query_timeout，事务不需要通过 DBPoolTxContext 开启
+// 返回的 DBLogRows 需要 Close 以释放超时计时
+func DBPoolLogQueryContext(ctx context.Context, sqlDb DBContextExecutor, query string, args ...interface{}) (*DBLogRows, error) {
+	startExecTime := time.Now()
+	qctx, cancel := dbQueryContext(ctx, sqlDb)
+	rows, err := sqlDb.QueryContext(qctx, query, args...)
+	logDBQueryContext(qctx, GetTrace(ctx), sqlDb, query, args, startExecTime, -1, err)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &DBLogRows{Rows: rows, cancel: cancel}, nil
+}
+
+type DBLogRows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+}
+
+func (r *DBLogRows) Close() error {
+	err := r.Rows.Close()
+	r.cancel()
+	return err
+}
+
+func DBPoolLogExecContext(ctx context.Context, sqlDb DBContextExecutor, query string, args ...interface{}) (sql.Result, error) {
+	startExecTime := time.Now()
+	qctx, cancel := dbQueryContext(ctx, sqlDb)
+	defer cancel()
+	result, err := sqlDb.ExecContext(qctx, query, args...)
+	var affected int64 = -1
+	if err == nil {
+		affected, _ = result.RowsAffected()
+	}
+	logDBQueryContext(qctx, GetTrace(ctx), sqlDb, query, args, startExecTime, affected, err)
+	return result, err
+}
+
+func DBPoolLogQueryRowContext(ctx context.Context, sqlDb DBContextExecutor, query string, args ...interface{}) *DBLogRow {
+	startExecTime := time.Now()
+	qctx, cancel := dbQueryContext(ctx, sqlDb)
+	row := sqlDb.QueryRowContext(qctx, query, args...)
+	return &DBLogRow{row: row, trace: GetTrace(ctx), db: sqlDb, query: query, args: args, startExecTime: startExecTime, ctx: qctx, cancel: cancel}
+}
+
+// 预编译语句，语句执行时不受 query_timeout 限制，使用 *sql.Stmt 的 Context 方法传入 ctx
+func DBPoolLogPrepareContext(ctx context.Context, sqlDb DBContextExecutor, query string) (*DBLogStmt, error) {
+	startExecTime := time.Now()
+	qctx, cancel := dbQueryContext(ctx, sqlDb)
+	defer cancel()
+	trace := GetTrace(ctx)
+	stmt, err := sqlDb.PrepareContext(qctx, query)
+	logDBQueryContext(qctx, trace, sqlDb, query, nil, startExecTime, -1, err)
+	if err != nil {
+		return nil, err
+	}
+	return &DBLogStmt{Stmt: stmt, trace: trace, db: sqlDb, query: query}, nil
+}
+
+// 同 DBPoolTx，ctx 结束时回滚事务
+// fn 中使用 DBPoolLog*Context 执行的 sql 同样受所属连接池的 query_timeout 限制
+func DBPoolTxContext(ctx context.Context, sqlDb DBTxBeginner, fn func(tx *sql.Tx) error) (err error) {
+	trace := GetTrace(ctx)
+	startExecTime := time.Now()
+	tx, err := sqlDb.BeginTx(ctx, nil)
+	logDBQueryContext(ctx, trace, sqlDb, "BEGIN", nil, startExecTime, -1, err)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			startExecTime := time.Now()
+			rbErr := tx.Rollback()
+			logDBQuery(trace, tx, "ROLLBACK", nil, startExecTime, -1, rbErr)
+			panic(p)
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		startExecTime := time.Now()
+		rbErr := tx.Rollback()
+		if rbErr == sql.ErrTxDone {
+			// ctx 结束时事务已经回滚
+			rbErr = nil
+		}
+		logDBQuery(trace, tx, "ROLLBACK", nil, startExecTime, -1, rbErr)
+		return err
+	}
+	startExecTime = time.Now()
+	err = tx.Commit()
+	logDBQueryContext(ctx, trace, tx, "COMMIT", nil, startExecTime, -1, err)
+	return err
+}
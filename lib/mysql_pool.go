@@ -0,0 +1,304 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDBSlaveCheckInterval = 5 * time.Second
+	dbSlavePingTimeout          = time.Second
+)
+
+// 读写分离的连接池，对应 mysql_map 中的一个 [list.<name>]
+//
+// 读语句（SELECT、SHOW 等，不含 FOR UPDATE 和 LAST_INSERT_ID() 等依赖会话的语句）随机发送到健康的从库，配置 slave_weights 时按权重随机，
+// 写语句和事务发送到主库，没有健康的从库时读语句也发送到主库
+// ctx 经过 ForceMaster 处理后，带 ctx 的方法全部使用主库
+// 从库每隔 slave_check_interval 秒 PING 一次，失败时摘除，成功后恢复
+type DBPool struct {
+	Name string
+
+	master  *sql.DB
+	slaves  []*dbSlave
+	weights bool
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+type dbSlave struct {
+	db      *sql.DB
+	weight  int
+	lock    sync.RWMutex
+	healthy bool
+	lastErr error
+}
+
+func (s *dbSlave) isHealthy() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.healthy
+}
+
+func (s *dbSlave) setHealthy(name string, idx int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	healthy := err == nil
+	if healthy != s.healthy {
+		if healthy {
+			fmt.Printf("[INFO] %s mysql [%v] slave %d recovered.\n", time.Now().Format(TimeFormat), name, idx)
+		} else {
+			fmt.Printf("[WARN] %s mysql [%v] slave %d ejected. err=%v\n", time.Now().Format(TimeFormat), name, idx, err)
+		}
+	}
+	s.healthy = healthy
+	s.lastErr = err
+}
+
+// 按配置打开主库和从库，主库 PING 失败时返回错误，从库 PING 失败时摘除
+func openDBPool(name string, conf *MySQLConf) (*DBPool, error) {
+	if len(conf.SlaveWeights) > 0 && len(conf.SlaveWeights) != len(conf.Slaves) {
+		return nil, fmt.Errorf("mysql [%v] slave_weights length %d not match slaves length %d", name, len(conf.SlaveWeights), len(conf.Slaves))
+	}
+	open := func(dsn string) (*sql.DB, error) {
+		db, err := sql.Open("mysql", dsn)
+		if err != nil {
+			return nil, err
+		}
+		db.SetMaxOpenConns(conf.MaxOpenConn)
+		db.SetMaxIdleConns(conf.MaxIdleConn)
+		db.SetConnMaxLifetime(time.Duration(conf.MaxConnLifeTime) * time.Second)
+		return db, nil
+	}
+
+	master, err := open(conf.DataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	// 检查数据库连接是否仍然有效
+	if err := master.Ping(); err != nil {
+		master.Close()
+		return nil, err
+	}
+	slaves := make([]*sql.DB, 0, len(conf.Slaves))
+	for _, dsn := range conf.Slaves {
+		db, err := open(dsn)
+		if err != nil {
+			master.Close()
+			for _, s := range slaves {
+				s.Close()
+			}
+			return nil, err
+		}
+		slaves = append(slaves, db)
+	}
+	interval := time.Duration(conf.SlaveCheckInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultDBSlaveCheckInterval
+	}
+	return newDBPool(name, master, slaves, conf.SlaveWeights, interval), nil
+}
+
+func newDBPool(name string, master *sql.DB, slaves []*sql.DB, weights []int, checkInterval time.Duration) *DBPool {
+	p := &DBPool{Name: name, master: master, weights: len(weights) > 0, stop: make(chan struct{})}
+	for i, db := range slaves {
+		s := &dbSlave{db: db, weight: 1, healthy: true}
+		if p.weights {
+			s.weight = weights[i]
+		}
+		p.slaves = append(p.slaves, s)
+	}
+	if len(p.slaves) > 0 {
+		p.checkSlaves()
+		go p.checkSlavesLoop(checkInterval)
+	}
+	return p
+}
+
+func (p *DBPool) checkSlavesLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.checkSlaves()
+		}
+	}
+}
+
+// PING 所有从库，更新健康状态
+func (p *DBPool) checkSlaves() {
+	for i, s := range p.slaves {
+		ctx, cancel := context.WithTimeout(context.Background(), dbSlavePingTimeout)
+		err := s.db.PingContext(ctx)
+		cancel()
+		s.setHealthy(p.Name, i, err)
+	}
+}
+
+// 主库
+func (p *DBPool) Master() *sql.DB {
+	return p.master
+}
+
+// 随机选择一个健康的从库，没有时返回主库
+func (p *DBPool) Slave() *sql.DB {
+	total := 0
+	healthy := make([]*dbSlave, 0, len(p.slaves))
+	for _, s := range p.slaves {
+		if s.weight > 0 && s.isHealthy() {
+			healthy = append(healthy, s)
+			total += s.weight
+		}
+	}
+	if total == 0 {
+		return p.master
+	}
+	n := rand.Intn(total)
+	for _, s := range healthy {
+		if n < s.weight {
+			return s.db
+		}
+		n -= s.weight
+	}
+	return p.master
+}
+
+// 健康的从库数量
+func (p *DBPool) HealthySlaves() int {
+	n := 0
+	for _, s := range p.slaves {
+		if s.isHealthy() {
+			n++
+		}
+	}
+	return n
+}
+
+func (p *DBPool) route(ctx context.Context, query string) *sql.DB {
+	if isForceMaster(ctx) || !isDBReadQuery(query) {
+		return p.master
+	}
+	return p.Slave()
+}
+
+func (p *DBPool) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return p.master.Exec(query, args...)
+}
+
+func (p *DBPool) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return p.route(nil, query).Query(query, args...)
+}
+
+func (p *DBPool) QueryRow(query string, args ...interface{}) *sql.Row {
+	return p.route(nil, query).QueryRow(query, args...)
+}
+
+func (p *DBPool) Prepare(query string) (*sql.Stmt, error) {
+	return p.route(nil, query).Prepare(query)
+}
+
+func (p *DBPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return p.master.ExecContext(ctx, query, args...)
+}
+
+func (p *DBPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return p.route(ctx, query).QueryContext(ctx, query, args...)
+}
+
+func (p *DBPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return p.route(ctx, query).QueryRowContext(ctx, query, args...)
+}
+
+func (p *DBPool) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return p.route(ctx, query).PrepareContext(ctx, query)
+}
+
+func (p *DBPool) Begin() (*sql.Tx, error) {
+	return p.master.Begin()
+}
+
+func (p *DBPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return p.master.BeginTx(ctx, opts)
+}
+
+func (p *DBPool) Ping() error {
+	return p.master.Ping()
+}
+
+// 关闭主库和从库，可重复调用
+func (p *DBPool) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.stop)
+		err = p.master.Close()
+		for _, s := range p.slaves {
+			s.db.Close()
+		}
+	})
+	return err
+}
+
+type forceMasterKey struct{}
+
+// 返回的 ctx 用于 DBPool 带 ctx 的方法时，读语句也使用主库，用于写后立即读等场景
+func ForceMaster(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forceMasterKey{}, true)
+}
+
+func isForceMaster(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	force, _ := ctx.Value(forceMasterKey{}).(bool)
+	return force
+}
+
+// 依赖当前会话或需要加锁的语句，只能在主库执行
+var dbMasterOnlyQuery = regexp.MustCompile(`(?i)\b(?:last_insert_id|found_rows|row_count|connection_id|get_lock|release_lock|release_all_locks|is_free_lock|is_used_lock)\s*\(|\bfor\s+(?:update|share)\b|\block\s+in\s+share\s+mode\b|\binto\b|@`)
+
+// 判断是否为可以发送到从库的读语句
+// SELECT 中使用会话函数、锁函数、变量、FOR UPDATE 或 INTO 时发送到主库，字符串字面量中的内容不参与判断
+func isDBReadQuery(query string) bool {
+	switch dbQueryKeyword(query) {
+	case "SELECT":
+		return !dbMasterOnlyQuery.MatchString(dbFingerprintString.ReplaceAllString(query, "?"))
+	case "SHOW", "DESC", "DESCRIBE", "EXPLAIN":
+		return true
+	}
+	return false
+}
+
+// sql 的第一个关键字，转为大写，跳过开头的注释和括号
+func dbQueryKeyword(query string) string {
+	q := strings.TrimSpace(query)
+	for {
+		switch {
+		case strings.HasPrefix(q, "/*"):
+			end := strings.Index(q, "*/")
+			if end < 0 {
+				return ""
+			}
+			q = strings.TrimSpace(q[end+2:])
+			continue
+		case strings.HasPrefix(q, "("):
+			q = strings.TrimSpace(q[1:])
+			continue
+		}
+		break
+	}
+	end := strings.IndexAny(q, " \t\r\n(")
+	if end < 0 {
+		end = len(q)
+	}
+	return strings.ToUpper(q[:end])
+}
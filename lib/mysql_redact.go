@@ -0,0 +1,263 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// 替换敏感绑定参数的占位内容
+const dbRedactMask = "***"
+
+// 连接池的日志配置，事务和单个连接使用所属连接池的配置
+type dbLogConf struct {
+	slow   *dbSlowLog
+	redact *dbRedactPolicy
+}
+
+var (
+	emptyDBLogConf = &dbLogConf{}
+
+	dbLogConfLock sync.RWMutex
+	dbLogConfs    = map[interface{}]*dbLogConf{} // 连接池 => 日志配置
+)
+
+func setDBLogConf(db interface{}, conf *dbLogConf) {
+	dbLogConfLock.Lock()
+	defer dbLogConfLock.Unlock()
+	if conf != nil && conf != emptyDBLogConf {
+		dbLogConfs[db] = conf
+	} else {
+		delete(dbLogConfs, db)
+	}
+}
+
+// 没有配置时返回空配置，*sql.Tx 和 *sql.Conn 按所属连接池查找，不需要通过 DBPoolTx 开启
+func getDBLogConf(db interface{}) *dbLogConf {
+	if db == nil {
+		return emptyDBLogConf
+	}
+	dbLogConfLock.RLock()
+	defer dbLogConfLock.RUnlock()
+	if conf, ok := dbLogConfs[db]; ok {
+		return conf
+	}
+	if owner := dbOwnerAddr(db); owner != 0 {
+		for key, conf := range dbLogConfs {
+			if dbAddr(key) == owner {
+				return conf
+			}
+		}
+	}
+	return emptyDBLogConf
+}
+
+func resetDBLogConf() {
+	dbLogConfLock.Lock()
+	defer dbLogConfLock.Unlock()
+	dbLogConfs = map[interface{}]*dbLogConf{}
+}
+
+// 绑定参数脱敏规则，对应连接池的 redact_columns、redact_max_len 和 redact_hash
+type dbRedactPolicy struct {
+	columns []*regexp.Regexp
+	maxLen  int
+	hash    bool
+}
+
+func newDBRedactPolicy(conf *MySQLConf) (*dbRedactPolicy, error) {
+	if len(conf.RedactColumns) == 0 && conf.RedactMaxLen <= 0 {
+		return nil, nil
+	}
+	p := &dbRedactPolicy{maxLen: conf.RedactMaxLen, hash: conf.RedactHash}
+	for _, pattern := range conf.RedactColumns {
+		// 匹配完整的列名，phone 不匹配 phone_verified
+		re, err := regexp.Compile("(?i)^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact_columns %q. err=%v", pattern, err)
+		}
+		p.columns = append(p.columns, re)
+	}
+	return p, nil
+}
+
+// 返回用于日志的绑定参数，列名匹配 redact_columns 的参数替换为 *** 或哈希，其余字符串超过 redact_max_len 时截断
+// 不修改 args，p 为 nil 时原样返回
+func (p *dbRedactPolicy) redact(query string, args []interface{}) []interface{} {
+	if p == nil || len(args) == 0 {
+		return args
+	}
+	var columns []string
+	if len(p.columns) > 0 {
+		columns = dbBindColumns(query, len(args))
+	}
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		if columns != nil && p.match(columns[i]) {
+			values[i] = p.mask(arg)
+		} else {
+			values[i] = p.truncate(arg)
+		}
+	}
+	return values
+}
+
+func (p *dbRedactPolicy) match(column string) bool {
+	if column == "" {
+		return false
+	}
+	for _, re := range p.columns {
+		if re.MatchString(column) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact_hash 时记录 sha256 前 8 字节，相同的值可以关联
+func (p *dbRedactPolicy) mask(arg interface{}) interface{} {
+	value, ok := dbBindString(arg)
+	if !ok {
+		return nil
+	}
+	if !p.hash {
+		return dbRedactMask
+	}
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+func (p *dbRedactPolicy) truncate(arg interface{}) interface{} {
+	if p.maxLen <= 0 {
+		return arg
+	}
+	var value string
+	switch v := arg.(type) {
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	default:
+		return arg
+	}
+	// 与 redact_max_len 一致，长度按字符数计算
+	n := utf8.RuneCountInString(value)
+	if n <= p.maxLen {
+		return arg
+	}
+	return fmt.Sprintf("%s...(len=%d)", string([]rune(value)[:p.maxLen]), n)
+}
+
+// 绑定参数的字符串形式，NULL 时返回 false
+func dbBindString(arg interface{}) (string, bool) {
+	v := reflect.Indirect(reflect.ValueOf(arg))
+	if !v.IsValid() {
+		return "", false
+	}
+	arg = v.Interface()
+	if r, ok := arg.(driver.Valuer); ok {
+		value, err := r.Value()
+		if err != nil || value == nil {
+			return "", false
+		}
+		arg = value
+	}
+	switch value := arg.(type) {
+	case []byte:
+		return string(value), true
+	case time.Time:
+		return value.Format(time.RFC3339Nano), true
+	}
+	return fmt.Sprint(arg), true
+}
+
+var (
+	// INSERT/REPLACE 的列名和 VALUES 起始位置
+	dbBindInsert = regexp.MustCompile("(?is)^\\s*(?:insert|replace)\\s+(?:(?:low_priority|delayed|high_priority|ignore)\\s+)*(?:into\\s+)?[\\w.`]+\\s*\\(([^)]*)\\)\\s*values?\\s*")
+	// 占位符前的 列名 操作符，IN 列表中的占位符使用 IN 前的列名，函数参数中的占位符使用函数前的列名，如 password = MD5(?)
+	dbBindColumn = regexp.MustCompile("(?is)([\\w`]+)\\s*(?:=|<=>|!=|<>|<=|>=|<|>|\\bnot\\s+like|\\blike|\\bnot\\s+in\\s*\\(|\\bin\\s*\\()(?:\\s*\\w+\\s*\\()*[\\s?,]*$")
+)
+
+// 按 sql 模板推断每个 ? 占位符对应的列名，列名转为小写，无法推断时为空
+func dbBindColumns(query string, n int) []string {
+	columns := make([]string, n)
+	var insertColumns []string
+	valuesStart := -1
+	if m := dbBindInsert.FindStringSubmatchIndex(query); m != nil {
+		for _, column := range strings.Split(query[m[2]:m[3]], ",") {
+			insertColumns = append(insertColumns, dbBindColumnName(column))
+		}
+		valuesStart = m[1]
+	}
+
+	inValues := valuesStart >= 0
+	depth, tupleIdx, idx := 0, 0, 0
+	var quote byte
+	for i := 0; i < len(query) && idx < n; i++ {
+		c := query[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		values := inValues && i >= valuesStart
+		switch c {
+		case '\'', '"', '`':
+			quote = c
+		case '(':
+			if values {
+				if depth++; depth == 1 {
+					tupleIdx = 0
+				}
+			}
+		case ')':
+			if values {
+				depth--
+			}
+		case ',':
+			if values && depth == 1 {
+				tupleIdx++
+			}
+		case '?':
+			if values && depth > 0 {
+				if tupleIdx < len(insertColumns) {
+					columns[idx] = insertColumns[tupleIdx]
+				}
+			} else {
+				start := i - 128
+				if start < 0 {
+					start = 0
+				}
+				if m := dbBindColumn.FindStringSubmatch(query[start:i]); m != nil {
+					columns[idx] = dbBindColumnName(m[1])
+				}
+			}
+			idx++
+		case ' ', '\t', '\r', '\n':
+		default:
+			// VALUES 之后的 ON DUPLICATE KEY UPDATE 等按普通占位符处理
+			if values && depth == 0 {
+				inValues = false
+			}
+		}
+	}
+	return columns
+}
+
+func dbBindColumnName(column string) string {
+	column = strings.TrimSpace(column)
+	if i := strings.LastIndex(column, "."); i >= 0 {
+		column = column[i+1:]
+	}
+	return strings.ToLower(strings.Trim(column, "`"))
+}
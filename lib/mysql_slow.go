@@ -0,0 +1,222 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDBSlowExplainInterval = time.Minute
+	dbSlowExplainTimeout         = 5 * time.Second
+)
+
+// 慢查询统计最多保留的 sql 指纹数，超过时淘汰总耗时最少的指纹
+var DBSlowQueryMaxFingerprints = 1000
+
+// 按 sql 指纹汇总的慢查询，见 GetDBSlowQueries
+type DBSlowQueryStat struct {
+	Pool        string
+	Fingerprint string
+	Sample      string // 最近一次的 sql 模板，不含绑定参数
+	Count       int64
+	TotalTime   time.Duration
+	MaxTime     time.Duration
+	LastTime    time.Time
+}
+
+type dbSlowQueryEntry struct {
+	DBSlowQueryStat
+	lastExplain time.Time
+}
+
+var (
+	dbSlowLock    sync.Mutex
+	dbSlowQueries = map[string]*dbSlowQueryEntry{} // 连接池名 + sql 指纹 => 统计
+)
+
+// 按总耗时从大到小返回前 n 个慢查询，n 小于等于 0 时返回全部
+func GetDBSlowQueries(n int) []DBSlowQueryStat {
+	dbSlowLock.Lock()
+	stats := make([]DBSlowQueryStat, 0, len(dbSlowQueries))
+	for _, entry := range dbSlowQueries {
+		stats = append(stats, entry.DBSlowQueryStat)
+	}
+	dbSlowLock.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].TotalTime > stats[j].TotalTime
+	})
+	if n > 0 && len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+// 清空慢查询统计
+func ResetDBSlowQueries() {
+	dbSlowLock.Lock()
+	defer dbSlowLock.Unlock()
+	dbSlowQueries = map[string]*dbSlowQueryEntry{}
+}
+
+// 连接池的慢查询配置，对应 slow_threshold_ms
+type dbSlowLog struct {
+	pool            string
+	threshold       time.Duration
+	explain         DBContextExecutor // 执行 EXPLAIN 的连接池，nil 时不执行
+	explainInterval time.Duration
+}
+
+func newDBSlowLog(name string, conf *MySQLConf, db DBContextExecutor) *dbSlowLog {
+	if conf.SlowThreshold <= 0 {
+		return nil
+	}
+	slow := &dbSlowLog{pool: name, threshold: time.Duration(conf.SlowThreshold) * time.Millisecond}
+	if conf.SlowExplain {
+		slow.explain = db
+		slow.explainInterval = time.Duration(conf.SlowExplainInterval) * time.Second
+		if slow.explainInterval <= 0 {
+			slow.explainInterval = defaultDBSlowExplainInterval
+		}
+	}
+	return slow
+}
+
+func (s *dbSlowLog) isSlow(procTime time.Duration) bool {
+	return s != nil && procTime >= s.threshold
+}
+
+// 按 DLTagMySqlSlow 记录慢查询并计入统计，SELECT 按指纹限频执行 EXPLAIN
+func (s *dbSlowLog) log(trace *TraceContext, query string, args []interface{}, procTime time.Duration, fields map[string]interface{}) {
+	fields["slow_threshold"] = fmt.Sprintf("%f", s.threshold.Seconds())
+	Log.TagWarn(trace, DLTagMySqlSlow, fields)
+
+	if s.record(query, procTime) {
+		go s.runExplain(trace, query, args)
+	}
+}
+
+// 计入统计，返回是否需要执行 EXPLAIN
+func (s *dbSlowLog) record(query string, procTime time.Duration) bool {
+	fingerprint := dbQueryFingerprint(query)
+	key := s.pool + "\x00" + fingerprint
+	now := time.Now()
+
+	dbSlowLock.Lock()
+	defer dbSlowLock.Unlock()
+	entry, ok := dbSlowQueries[key]
+	if !ok {
+		if DBSlowQueryMaxFingerprints <= 0 {
+			return false
+		}
+		if len(dbSlowQueries) >= DBSlowQueryMaxFingerprints {
+			evictDBSlowQuery()
+		}
+		entry = &dbSlowQueryEntry{DBSlowQueryStat: DBSlowQueryStat{Pool: s.pool, Fingerprint: fingerprint}}
+		dbSlowQueries[key] = entry
+	}
+	entry.Sample = query
+	entry.Count++
+	entry.TotalTime += procTime
+	if procTime > entry.MaxTime {
+		entry.MaxTime = procTime
+	}
+	entry.LastTime = now
+
+	if s.explain == nil || dbQueryKeyword(query) != "SELECT" || !isDBReadQuery(query) {
+		return false
+	}
+	if !entry.lastExplain.IsZero() && now.Sub(entry.lastExplain) < s.explainInterval {
+		return false
+	}
+	entry.lastExplain = now
+	return true
+}
+
+// 淘汰总耗时最少的指纹，调用方持有 dbSlowLock
+func evictDBSlowQuery() {
+	var minKey string
+	var minEntry *dbSlowQueryEntry
+	for key, entry := range dbSlowQueries {
+		if minEntry == nil || entry.TotalTime < minEntry.TotalTime {
+			minKey, minEntry = key, entry
+		}
+	}
+	delete(dbSlowQueries, minKey)
+}
+
+// 执行 EXPLAIN 并按 DLTagMySqlSlow 记录执行计划
+func (s *dbSlowLog) runExplain(trace *TraceContext, query string, args []interface{}) {
+	startExecTime := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), dbSlowExplainTimeout)
+	defer cancel()
+	plan, err := queryDBExplain(ctx, s.explain, query, args)
+	fields := map[string]interface{}{
+		"sql":       "EXPLAIN " + query,
+		"proc_time": fmt.Sprintf("%f", time.Since(startExecTime).Seconds()),
+	}
+	if err != nil {
+		fields["err"] = err
+		Log.TagError(trace, DLTagMySqlFailed, fields)
+		return
+	}
+	fields["explain"] = plan
+	Log.TagWarn(trace, DLTagMySqlSlow, fields)
+}
+
+func queryDBExplain(ctx context.Context, db DBContextExecutor, query string, args []interface{}) ([]map[string]string, error) {
+	rows, err := db.QueryContext(ctx, "EXPLAIN "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var plan []map[string]string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]string, len(columns))
+		for i, column := range columns {
+			if values[i].Valid {
+				row[column] = values[i].String
+			} else {
+				row[column] = "NULL"
+			}
+		}
+		plan = append(plan, row)
+	}
+	return plan, rows.Err()
+}
+
+var (
+	dbFingerprintString = regexp.MustCompile(`'(?:[^'\\]|\\.)*'|"(?:[^"\\]|\\.)*"`)
+	dbFingerprintNumber = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	dbFingerprintSpace  = regexp.MustCompile(`\s+`)
+	dbFingerprintList   = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	dbFingerprintValues = regexp.MustCompile(`(\(\?\+\))(?:\s*,\s*\(\?\+\))+`)
+)
+
+// sql 指纹：字面量替换为 ?，IN 列表和多行 VALUES 合并，空白合并，转为小写
+func dbQueryFingerprint(query string) string {
+	q := dbFingerprintString.ReplaceAllString(query, "?")
+	q = dbFingerprintNumber.ReplaceAllString(q, "?")
+	q = dbFingerprintSpace.ReplaceAllString(q, " ")
+	q = dbFingerprintList.ReplaceAllString(q, "(?+)")
+	q = dbFingerprintValues.ReplaceAllString(q, "$1")
+	return strings.ToLower(strings.TrimSpace(q))
+}
@@ -0,0 +1,569 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	dlog "github.com/yaolixiao/golang_common/log"
+)
+
+// 收集日志，用于检查日志内容
+type testLogWriter struct {
+	lock    sync.Mutex
+	records []string
+}
+
+func (w *testLogWriter) Init() error {
+	return nil
+}
+
+func (w *testLogWriter) Write(r *dlog.Record) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.records = append(w.records, r.String())
+	return nil
+}
+
+// 等待包含 substrs 全部内容的日志
+func (w *testLogWriter) wait(t *testing.T, substrs ...string) string {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		w.lock.Lock()
+		for _, r := range w.records {
+			matched := true
+			for _, s := range substrs {
+				if !strings.Contains(r, s) {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				w.lock.Unlock()
+				return r
+			}
+		}
+		w.lock.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("log %q not found", substrs)
+	return ""
+}
+
+// 每个测试注册新的 writer，其他测试调用 Destroy 关闭日志后重新创建的 logger 中也能收集到
+func newTestLogWriter() *testLogWriter {
+	w := &testLogWriter{}
+	dlog.Register(w)
+	return w
+}
+
+// 测试带日志的 sql 执行
+func TestDBPoolLog(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	w := newTestLogWriter()
+	trace := NewTrace()
+
+	mock.ExpectExec("UPDATE user").WithArgs("foo", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	if _, err := DBPoolLogExec(trace, db, "UPDATE user SET name = ? WHERE id = ?", "foo", 1); err != nil {
+		t.Fatal(err)
+	}
+	w.wait(t, DLTagMySqlSuccess, "UPDATE user SET name", "affected_row=1")
+
+	mock.ExpectQuery("SELECT name").WithArgs(2).WillReturnError(errors.New("table missing"))
+	if _, err := DBPoolLogQuery(trace, db, "SELECT name FROM user WHERE id = ?", 2); err == nil {
+		t.Fatal("expect query error")
+	}
+	w.wait(t, DLTagMySqlFailed, "SELECT name FROM user", "table missing")
+
+	mock.ExpectQuery("SELECT name").WithArgs(3).WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("bar"))
+	var name string
+	if err := DBPoolLogQueryRow(trace, db, "SELECT name FROM user WHERE id = ?", 3).Scan(&name); err != nil || name != "bar" {
+		t.Fatalf("name=%v err=%v", name, err)
+	}
+	mock.ExpectQuery("SELECT name").WithArgs(4).WillReturnRows(sqlmock.NewRows([]string{"name"}))
+	if err := DBPoolLogQueryRow(trace, db, "SELECT name FROM user WHERE id = ?", 4).Scan(&name); err != sql.ErrNoRows {
+		t.Fatalf("err=%v", err)
+	}
+	w.wait(t, DLTagMySqlSuccess, "SELECT name FROM user", "bind=[4]", "affected_row=0")
+
+	mock.ExpectPrepare("INSERT INTO user").ExpectExec().WithArgs("baz").WillReturnResult(sqlmock.NewResult(5, 1))
+	stmt, err := DBPoolLogPrepare(trace, db, "INSERT INTO user (name) VALUES (?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stmt.Exec("baz"); err != nil {
+		t.Fatal(err)
+	}
+	stmt.Close()
+	w.wait(t, DLTagMySqlSuccess, "INSERT INTO user", "bind=[baz]")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 测试事务提交、回滚和 panic 回滚
+func TestDBPoolTx(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	w := newTestLogWriter()
+	trace := NewTrace()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE account").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	err = DBPoolTx(trace, db, func(tx *sql.Tx) error {
+		_, err := DBPoolLogExec(trace, tx, "UPDATE account SET balance = balance - 1")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.wait(t, DLTagMySqlSuccess, "sql=COMMIT")
+
+	fail := errors.New("insufficient balance")
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	if err := DBPoolTx(trace, db, func(tx *sql.Tx) error { return fail }); err != fail {
+		t.Fatalf("err=%v", err)
+	}
+	w.wait(t, DLTagMySqlSuccess, "sql=ROLLBACK")
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Fatalf("recover=%v", p)
+			}
+		}()
+		DBPoolTx(trace, db, func(tx *sql.Tx) error { panic("boom") })
+	}()
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 测试 query_timeout 和 ctx 取消
+func TestDBPoolLogContext(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer resetDBQueryTimeout()
+	setDBQueryTimeout(db, 50*time.Millisecond)
+	w := newTestLogWriter()
+	ctx := WithTrace(context.Background(), NewTrace())
+
+	mock.ExpectQuery("SELECT SLEEP").WillDelayFor(time.Second).WillReturnRows(sqlmock.NewRows([]string{"v"}).AddRow(1))
+	startTime := time.Now()
+	if _, err := DBPoolLogQueryContext(ctx, db, "SELECT SLEEP(1)"); err == nil {
+		t.Fatal("expect timeout")
+	}
+	if d := time.Since(startTime); d > 500*time.Millisecond {
+		t.Fatalf("query not canceled after %v", d)
+	}
+	w.wait(t, DLTagMySqlTimeout, "SELECT SLEEP(1)")
+
+	mock.ExpectQuery("SELECT id").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	rows, err := DBPoolLogQueryContext(ctx, db, "SELECT id FROM user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	rows.Close()
+	if n != 2 {
+		t.Fatalf("rows=%d", n)
+	}
+
+	// 调用方取消不视为超时
+	cctx, cancel := context.WithCancel(ctx)
+	mock.ExpectExec("UPDATE user").WillDelayFor(time.Second).WillReturnResult(sqlmock.NewResult(0, 1))
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := DBPoolLogExecContext(cctx, db, "UPDATE user SET name = ?", "canceled"); err == nil {
+		t.Fatal("expect canceled")
+	}
+	w.wait(t, DLTagMySqlFailed, "UPDATE user SET name", "canceled")
+
+	mock.ExpectQuery("SELECT name").WillDelayFor(time.Second).WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("foo"))
+	var name string
+	if err := DBPoolLogQueryRowContext(ctx, db, "SELECT name FROM user WHERE id = ?", 7).Scan(&name); err == nil {
+		t.Fatal("expect timeout")
+	}
+	w.wait(t, DLTagMySqlTimeout, "SELECT name FROM user", "bind=[7]")
+
+	// 事务中的 sql 同样受 query_timeout 限制
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE account").WillDelayFor(time.Second).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+	err = DBPoolTxContext(ctx, db, func(tx *sql.Tx) error {
+		_, err := DBPoolLogExecContext(ctx, tx, "UPDATE account SET balance = 0")
+		return err
+	})
+	if err == nil {
+		t.Fatal("expect timeout")
+	}
+	w.wait(t, DLTagMySqlTimeout, "UPDATE account")
+
+	// 直接开启的事务使用所属连接池的 query_timeout
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE account").WillDelayFor(time.Second).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime = time.Now()
+	if _, err := DBPoolLogExecContext(ctx, tx, "UPDATE account SET balance = 1"); err == nil {
+		t.Fatal("expect timeout")
+	}
+	if d := time.Since(startTime); d > 500*time.Millisecond {
+		t.Fatalf("tx query not canceled after %v", d)
+	}
+	tx.Rollback()
+	w.wait(t, DLTagMySqlTimeout, "UPDATE account SET balance = 1")
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 测试读写分离、从库摘除和恢复
+func TestDBPoolReadWriteSplit(t *testing.T) {
+	master, mm, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slave1, m1, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slave2, m2, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m1.ExpectPing()
+	m2.ExpectPing()
+	// slave2 权重为 0，读语句都发送到 slave1
+	pool := newDBPool("test", master, []*sql.DB{slave1, slave2}, []int{1, 0}, time.Hour)
+	defer pool.Close()
+	trace := NewTrace()
+	ctx := WithTrace(context.Background(), trace)
+
+	m1.ExpectQuery("SELECT name").WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("foo"))
+	var name string
+	if err := DBPoolLogQueryRow(trace, pool, "/* hint */ SELECT name FROM user WHERE id = ?", 1).Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	mm.ExpectExec("UPDATE user").WillReturnResult(sqlmock.NewResult(0, 1))
+	if _, err := DBPoolLogExec(trace, pool, "UPDATE user SET name = ?", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	mm.ExpectQuery("SELECT name").WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("bar"))
+	if _, err := DBPoolLogQuery(trace, pool, "SELECT name FROM user WHERE id = ? FOR UPDATE", 1); err != nil {
+		t.Fatal(err)
+	}
+	// 依赖会话的语句使用主库
+	mm.ExpectQuery("SELECT LAST_INSERT_ID").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	var id int
+	if err := DBPoolLogQueryRow(trace, pool, "SELECT LAST_INSERT_ID()").Scan(&id); err != nil || id != 1 {
+		t.Fatalf("id=%v err=%v", id, err)
+	}
+	mm.ExpectQuery("SELECT name").WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("bar"))
+	if err := DBPoolLogQueryRowContext(ForceMaster(ctx), pool, "SELECT name FROM user WHERE id = ?", 1).Scan(&name); err != nil || name != "bar" {
+		t.Fatalf("name=%v err=%v", name, err)
+	}
+	mm.ExpectBegin()
+	mm.ExpectQuery("SELECT balance").WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(1))
+	mm.ExpectCommit()
+	err = DBPoolTx(trace, pool, func(tx *sql.Tx) error {
+		var balance int
+		return DBPoolLogQueryRow(trace, tx, "SELECT balance FROM account").Scan(&balance)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// gorm 同样读写分离
+	dbgorm, err := newGormDB(pool, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m1.ExpectQuery("SELECT name").WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("foo"))
+	if err := dbgorm.Raw("SELECT name FROM user WHERE id = ?", 1).Row().Scan(&name); err != nil || name != "foo" {
+		t.Fatalf("name=%v err=%v", name, err)
+	}
+	mm.ExpectExec("UPDATE user").WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := dbgorm.Exec("UPDATE user SET name = ?", "baz").Error; err != nil {
+		t.Fatal(err)
+	}
+	// 使用主库的 gorm 可以设置连接池
+	if dbgorm, err := newGormDB(pool.Master(), nil); err != nil || dbgorm.DB() != master {
+		t.Fatalf("db=%v err=%v", dbgorm.DB(), err)
+	}
+
+	// slave1 PING 失败时摘除，没有可用从库时读主库
+	m1.ExpectPing().WillReturnError(errors.New("connection refused"))
+	m2.ExpectPing()
+	pool.checkSlaves()
+	if n := pool.HealthySlaves(); n != 1 {
+		t.Fatalf("healthy slaves=%d", n)
+	}
+	mm.ExpectQuery("SELECT name").WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("bar"))
+	if err := DBPoolLogQueryRow(trace, pool, "SELECT name FROM user WHERE id = ?", 1).Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+
+	m1.ExpectPing()
+	m2.ExpectPing()
+	pool.checkSlaves()
+	if n := pool.HealthySlaves(); n != 2 {
+		t.Fatalf("healthy slaves=%d", n)
+	}
+	m1.ExpectQuery("SHOW TABLES").WillReturnRows(sqlmock.NewRows([]string{"table"}).AddRow("user"))
+	if _, err := DBPoolLogQuery(trace, pool, "SHOW TABLES"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []sqlmock.Sqlmock{mm, m1, m2} {
+		if err := m.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIsDBReadQuery(t *testing.T) {
+	for query, want := range map[string]bool{
+		"SELECT name FROM user WHERE id = ?":                  true,
+		"/* hint */ (SELECT name FROM user) UNION (SELECT 1)": true,
+		"select name from user where email = 'a@b.com'":       true,
+		"SELECT name FROM user WHERE note = 'for update'":     true,
+		"SHOW TABLES": true,
+		"SELECT name FROM user WHERE id = ? FOR UPDATE": false,
+		"SELECT name FROM user LOCK IN SHARE MODE":      false,
+		"SELECT LAST_INSERT_ID()":                       false,
+		"SELECT FOUND_ROWS()":                           false,
+		"SELECT GET_LOCK('job', 10)":                    false,
+		"select release_lock('job')":                    false,
+		"SELECT @@session.tx_isolation":                 false,
+		"SELECT name INTO @name FROM user":              false,
+		"UPDATE user SET name = ?":                      false,
+		"INSERT INTO user SELECT * FROM tmp":            false,
+	} {
+		if got := isDBReadQuery(query); got != want {
+			t.Errorf("query=%q read=%v, want %v", query, got, want)
+		}
+	}
+}
+
+// 测试慢查询日志、EXPLAIN 限频和指纹汇总
+func TestDBSlowQuery(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// EXPLAIN 异步执行，不限制顺序
+	mock.MatchExpectationsInOrder(false)
+	slow := newDBSlowLog("test", &MySQLConf{SlowThreshold: 20, SlowExplain: true}, db)
+	logConf := &dbLogConf{slow: slow}
+	setDBLogConf(db, logConf)
+	defer resetDBLogConf()
+	defer ResetDBSlowQueries()
+	w := newTestLogWriter()
+	trace := NewTrace()
+
+	mock.ExpectQuery("SELECT name").WithArgs(5).WillDelayFor(50 * time.Millisecond).WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("foo"))
+	mock.ExpectQuery("EXPLAIN SELECT name").WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"id", "type", "key"}).AddRow(1, "ALL", nil))
+	var name string
+	if err := DBPoolLogQueryRow(trace, db, "SELECT name FROM user WHERE id = ?", 5).Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	w.wait(t, DLTagMySqlSlow, "sql=SELECT name FROM user", "bind=[5]", "slow_threshold=0.020000")
+	w.wait(t, DLTagMySqlSlow, "sql=EXPLAIN SELECT name", "type:ALL", "key:NULL")
+
+	// 同一指纹在 slow_explain_interval 内不再 EXPLAIN
+	mock.ExpectQuery("SELECT name").WithArgs(6).WillDelayFor(50 * time.Millisecond).WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("bar"))
+	if err := DBPoolLogQueryRow(trace, db, "SELECT name FROM user WHERE id = ?", 6).Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery("SELECT id").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	if _, err := DBPoolLogQuery(trace, db, "SELECT id FROM user"); err != nil {
+		t.Fatal(err)
+	}
+	w.wait(t, DLTagMySqlSuccess, "sql=SELECT id FROM user")
+
+	// 事务中的 sql 和 gorm 使用连接池的配置
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE user").WillDelayFor(30 * time.Millisecond).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	err = DBPoolTx(trace, db, func(tx *sql.Tx) error {
+		_, err := DBPoolLogExec(trace, tx, "UPDATE user SET name = 'a' WHERE id IN (1, 2, 3)")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbgorm, err := newGormDB(db, logConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("DELETE FROM user").WillDelayFor(30 * time.Millisecond).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := dbgorm.Exec("DELETE FROM user WHERE id = ?", 7).Error; err != nil {
+		t.Fatal(err)
+	}
+	w.wait(t, DLTagMySqlSlow, "DELETE FROM user")
+
+	stats := GetDBSlowQueries(0)
+	if len(stats) != 3 {
+		t.Fatalf("stats=%+v", stats)
+	}
+	top := GetDBSlowQueries(1)
+	if len(top) != 1 || top[0].Fingerprint != "select name from user where id = ?" || top[0].Count != 2 || top[0].Pool != "test" {
+		t.Fatalf("top=%+v", top)
+	}
+	for _, stat := range stats {
+		if stat.Fingerprint == "update user set name = ? where id in (?+)" {
+			return
+		}
+	}
+	t.Fatalf("update fingerprint not found. stats=%+v", stats)
+}
+
+func TestDBQueryFingerprint(t *testing.T) {
+	cases := map[string]string{
+		"SELECT * FROM t1 WHERE id IN (1, 2,3) AND name = 'o\\'k'": "select * from t1 where id in (?+) and name = ?",
+		"INSERT INTO t (a, b) VALUES (?, ?), (?, ?)\n":             "insert into t (a, b) values (?+)",
+		"UPDATE  t SET v = 1.5\tWHERE k = \"x\"":                   "update t set v = ? where k = ?",
+	}
+	for query, expect := range cases {
+		if fingerprint := dbQueryFingerprint(query); fingerprint != expect {
+			t.Errorf("fingerprint(%q)=%q expect %q", query, fingerprint, expect)
+		}
+	}
+}
+
+// 测试绑定参数脱敏
+func TestDBRedact(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	redact, err := newDBRedactPolicy(&MySQLConf{RedactColumns: []string{"password", "phone|mobile"}, RedactMaxLen: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logConf := &dbLogConf{redact: redact}
+	setDBLogConf(db, logConf)
+	defer resetDBLogConf()
+	w := newTestLogWriter()
+	trace := NewTrace()
+
+	mock.ExpectExec("UPDATE user").WillReturnResult(sqlmock.NewResult(0, 1))
+	_, err = DBPoolLogExec(trace, db, "UPDATE user SET `password` = ?, u.phone = ?, phone_verified = ?, bio = ? WHERE id = ?", "secret", "13800000000", "yes", "long biography", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := w.wait(t, DLTagMySqlSuccess, "sql=UPDATE user SET `password` = ?", "bind=[*** *** yes long bio...(len=14) 1]")
+	if strings.Contains(r, "secret") || strings.Contains(r, "13800000000") {
+		t.Fatalf("bind not redacted: %s", r)
+	}
+
+	// 事务中使用连接池的规则
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO user").WillReturnResult(sqlmock.NewResult(1, 2))
+	mock.ExpectCommit()
+	err = DBPoolTx(trace, db, func(tx *sql.Tx) error {
+		_, err := DBPoolLogExec(trace, tx, "INSERT INTO user (name, mobile) VALUES (?, ?), (?, ?) ON DUPLICATE KEY UPDATE password = ?", "a", "139", "b", "137", "pwd")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.wait(t, DLTagMySqlSuccess, "sql=INSERT INTO user", "bind=[a *** b *** ***]")
+
+	// 直接开启的事务同样使用连接池的规则
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE user").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DBPoolLogExec(trace, tx, "UPDATE user SET password = MD5(?) WHERE id = ?", "raw-secret", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	r = w.wait(t, DLTagMySqlSuccess, "sql=UPDATE user SET password = MD5(?) WHERE id = ?", "bind=[*** 3]")
+	if strings.Contains(r, "raw-secret") {
+		t.Fatalf("tx bind not redacted: %s", r)
+	}
+
+	// gorm 的 sql 中同样脱敏，并记录 sql 模板
+	dbgorm, err := newGormDB(db, logConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("UPDATE user").WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := dbgorm.Exec("UPDATE user SET password = ? WHERE id = ?", "secret", 2).Error; err != nil {
+		t.Fatal(err)
+	}
+	r = w.wait(t, "sql=UPDATE user SET password = '***' WHERE id = '2'", "sql_template=UPDATE user SET password = ? WHERE id = ?")
+	if strings.Contains(r, "secret") {
+		t.Fatalf("sql not redacted: %s", r)
+	}
+
+	// 长度按字符数
+	if v := redact.truncate("中文字符串超过八个字符"); v != "中文字符串超过八...(len=11)" {
+		t.Fatalf("truncate=%v", v)
+	}
+
+	hash, _ := newDBRedactPolicy(&MySQLConf{RedactColumns: []string{"token"}, RedactHash: true})
+	bind := hash.redact("SELECT id FROM session WHERE token = ? OR token IN (?, ?)", []interface{}{"t1", "t1", nil})
+	if bind[0] != bind[1] || !strings.HasPrefix(bind[0].(string), "sha256:") || bind[2] != nil {
+		t.Fatalf("bind=%v", bind)
+	}
+	if _, err := newDBRedactPolicy(&MySQLConf{RedactColumns: []string{"("}}); err == nil {
+		t.Fatal("expect invalid pattern error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDBBindColumns(t *testing.T) {
+	cases := []struct {
+		query   string
+		columns []string
+	}{
+		{"SELECT * FROM t WHERE a.`Name` LIKE ? AND b IN (?, ?) AND c >= ?", []string{"name", "b", "b", "c"}},
+		{"REPLACE INTO t (`x`, y, z) VALUES (?, NOW(), ?), (?, ?, ?)", []string{"x", "z", "x", "y", "z"}},
+		{"SELECT * FROM t WHERE d = '?' AND e <> ? LIMIT ?", []string{"e", ""}},
+		{"UPDATE user SET password = MD5(?), phone = TRIM(?), token = AES_ENCRYPT(?, ?) WHERE email = LOWER(TRIM(?))", []string{"password", "phone", "token", "token", "email"}},
+	}
+	for _, c := range cases {
+		columns := dbBindColumns(c.query, len(c.columns))
+		if strings.Join(columns, ",") != strings.Join(c.columns, ",") {
+			t.Errorf("columns(%q)=%q expect %q", c.query, columns, c.columns)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 限流器，key 为限流对象，如用户 id、接口名
+type RateLimiter interface {
+	// 有剩余配额时占用一个并返回 true，否则返回 false，不占用配额
+	Allow(ctx context.Context, key string) (bool, error)
+	// 占用一个配额，返回需要等待的时间，返回 0 时可以立即执行
+	// 占用后不能归还，调用方放弃执行时配额仍然计入
+	Reserve(ctx context.Context, key string) (time.Duration, error)
+}
+
+// 令牌桶，每秒生成 rate 个令牌，最多积累 burst 个
+//
+// 基于 redis_map 中 name 对应连接池，使用 Lua 脚本保证原子性，多个实例共享配额
+// 时间以调用方本机时间为准，实例间时钟偏差会影响精度
+type RedisTokenBucket struct {
+	Prefix string // key 前缀
+
+	name  string
+	rate  float64
+	burst int
+	now   func() time.Time
+}
+
+func NewRedisTokenBucket(redisName string, rate float64, burst int) *RedisTokenBucket {
+	return &RedisTokenBucket{Prefix: "ratelimit:tb:", name: redisName, rate: rate, burst: burst, now: time.Now}
+}
+
+// 令牌数和时间保存在 hash 中，不足时 reserve=1 允许令牌为负数
+// 返回 {是否通过, 需要等待的毫秒数}
+const redisTokenBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local reserve = ARGV[4] == "1"
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) * rate)
+	ts = now
+end
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+elseif reserve then
+	tokens = tokens - 1
+	wait = math.ceil(-tokens / rate)
+else
+	return {0, math.ceil((1 - tokens) / rate)}
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(ts))
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) / rate) + 1000)
+return {1, wait}`
+
+func (l *RedisTokenBucket) Allow(ctx context.Context, key string) (bool, error) {
+	ok, _, err := l.eval(ctx, key, false)
+	return ok, err
+}
+
+func (l *RedisTokenBucket) Reserve(ctx context.Context, key string) (time.Duration, error) {
+	_, wait, err := l.eval(ctx, key, true)
+	return wait, err
+}
+
+func (l *RedisTokenBucket) eval(ctx context.Context, key string, reserve bool) (bool, time.Duration, error) {
+	reply, err := redis.Int64s(RedisLogDo(GetTrace(ctx), l.name, "EVAL", redisTokenBucketScript, 1, l.Prefix+key,
+		l.rate/1000, l.burst, l.now().UnixNano()/int64(time.Millisecond), boolArg(reserve)))
+	if err != nil {
+		return false, 0, err
+	}
+	return reply[0] == 1, time.Duration(reply[1]) * time.Millisecond, nil
+}
+
+// 滑动窗口，任意 window 时长内最多通过 limit 次
+//
+// 基于 redis_map 中 name 对应连接池，每次通过的时间记录在 sorted set 中，使用 Lua 脚本保证原子性
+// 时间以调用方本机时间为准，实例间时钟偏差会影响精度
+type RedisSlidingWindow struct {
+	Prefix string // key 前缀
+
+	name   string
+	limit  int
+	window time.Duration
+	now    func() time.Time
+}
+
+func NewRedisSlidingWindow(redisName string, limit int, window time.Duration) *RedisSlidingWindow {
+	return &RedisSlidingWindow{Prefix: "ratelimit:sw:", name: redisName, limit: limit, window: window, now: time.Now}
+}
+
+// 配额已满时 reserve=1 在最早可通过的时间记录一次，记录的时间可能晚于当前时间
+// 返回 {是否通过, 需要等待的毫秒数}
+const redisSlidingWindowScript = `
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local reserve = ARGV[4] == "1"
+local member = ARGV[5]
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+local count = redis.call("ZCARD", KEYS[1])
+local at = now
+if count >= limit then
+	local first = redis.call("ZRANGE", KEYS[1], count - limit, count - limit, "WITHSCORES")
+	at = tonumber(first[2]) + window
+	if not reserve then
+		return {0, at - now}
+	end
+end
+redis.call("ZADD", KEYS[1], at, member)
+redis.call("PEXPIRE", KEYS[1], at - now + window)
+return {1, at - now}`
+
+func (l *RedisSlidingWindow) Allow(ctx context.Context, key string) (bool, error) {
+	ok, _, err := l.eval(ctx, key, false)
+	return ok, err
+}
+
+func (l *RedisSlidingWindow) Reserve(ctx context.Context, key string) (time.Duration, error) {
+	_, wait, err := l.eval(ctx, key, true)
+	return wait, err
+}
+
+func (l *RedisSlidingWindow) eval(ctx context.Context, key string, reserve bool) (bool, time.Duration, error) {
+	member, err := newRateLimitMember()
+	if err != nil {
+		return false, 0, err
+	}
+	reply, err := redis.Int64s(RedisLogDo(GetTrace(ctx), l.name, "EVAL", redisSlidingWindowScript, 1, l.Prefix+key,
+		l.limit, l.window.Milliseconds(), l.now().UnixNano()/int64(time.Millisecond), boolArg(reserve), member))
+	if err != nil {
+		return false, 0, err
+	}
+	if reply[0] != 1 {
+		return false, 0, nil
+	}
+	return true, time.Duration(reply[1]) * time.Millisecond, nil
+}
+
+func boolArg(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// 同一毫秒内的多次记录需要不同的 member
+func newRateLimitMember() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// 内存令牌桶，算法同 RedisTokenBucket，只在当前进程内限流
+type MemoryTokenBucket struct {
+	rate  float64
+	burst int
+	now   func() time.Time
+
+	lock      sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	tokens float64
+	ts     time.Time
+}
+
+func NewMemoryTokenBucket(rate float64, burst int) *MemoryTokenBucket {
+	return &MemoryTokenBucket{rate: rate, burst: burst, now: time.Now, buckets: map[string]*memoryBucket{}}
+}
+
+func (l *MemoryTokenBucket) Allow(ctx context.Context, key string) (bool, error) {
+	ok, _ := l.take(key, false)
+	return ok, nil
+}
+
+func (l *MemoryTokenBucket) Reserve(ctx context.Context, key string) (time.Duration, error) {
+	_, wait := l.take(key, true)
+	return wait, nil
+}
+
+func (l *MemoryTokenBucket) take(key string, reserve bool) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: float64(l.burst), ts: now}
+		l.buckets[key] = b
+	}
+	if now.After(b.ts) {
+		b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.ts).Seconds()*l.rate)
+		b.ts = now
+	}
+	switch {
+	case b.tokens >= 1:
+		b.tokens--
+		return true, 0
+	case reserve:
+		b.tokens--
+		return true, time.Duration(-b.tokens / l.rate * float64(time.Second))
+	}
+	return false, 0
+}
+
+// 每分钟清理一次已经补满的令牌桶
+func (l *MemoryTokenBucket) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.ts).Seconds()*l.rate >= float64(l.burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// 内存滑动窗口，算法同 RedisSlidingWindow，只在当前进程内限流
+type MemorySlidingWindow struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	lock      sync.Mutex
+	logs      map[string][]time.Time // 按时间排序的通过记录
+	lastSweep time.Time
+}
+
+func NewMemorySlidingWindow(limit int, window time.Duration) *MemorySlidingWindow {
+	return &MemorySlidingWindow{limit: limit, window: window, now: time.Now, logs: map[string][]time.Time{}}
+}
+
+func (l *MemorySlidingWindow) Allow(ctx context.Context, key string) (bool, error) {
+	ok, _ := l.take(key, false)
+	return ok, nil
+}
+
+func (l *MemorySlidingWindow) Reserve(ctx context.Context, key string) (time.Duration, error) {
+	_, wait := l.take(key, true)
+	return wait, nil
+}
+
+func (l *MemorySlidingWindow) take(key string, reserve bool) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	logs := l.prune(l.logs[key], now)
+	at := now
+	if len(logs) >= l.limit {
+		at = logs[len(logs)-l.limit].Add(l.window)
+		if !reserve {
+			l.logs[key] = logs
+			return false, 0
+		}
+	}
+	idx := sort.Search(len(logs), func(i int) bool { return logs[i].After(at) })
+	logs = append(logs, time.Time{})
+	copy(logs[idx+1:], logs[idx:])
+	logs[idx] = at
+	l.logs[key] = logs
+	return true, at.Sub(now)
+}
+
+// 去掉窗口外的记录
+func (l *MemorySlidingWindow) prune(logs []time.Time, now time.Time) []time.Time {
+	start := now.Add(-l.window)
+	idx := sort.Search(len(logs), func(i int) bool { return logs[i].After(start) })
+	return logs[idx:]
+}
+
+// 每分钟清理一次没有记录的 key
+func (l *MemorySlidingWindow) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, logs := range l.logs {
+		if len(l.prune(logs, now)) == 0 {
+			delete(l.logs, key)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// 测试令牌桶和滑动窗口，redis 和内存实现结果一致
+func TestRateLimiter(t *testing.T) {
+	s := startTestRedis(t)
+	defer s.Close()
+	ConfRedisMap = &RedisMapConf{List: map[string]*RedisConf{
+		"default": {ProxyList: []string{s.Addr()}},
+	}}
+	if err := InitRedisPool(); err != nil {
+		t.Fatal(err)
+	}
+	defer CloseRedis()
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	ctx := context.Background()
+
+	type step struct {
+		advance time.Duration
+		reserve bool
+		allowed bool
+		wait    time.Duration
+	}
+	run := func(name string, l RateLimiter, steps []step) {
+		for i, st := range steps {
+			now = now.Add(st.advance)
+			if st.reserve {
+				wait, err := l.Reserve(ctx, "user:1")
+				if err != nil || wait != st.wait {
+					t.Fatalf("%v step %d: reserve wait=%v err=%v", name, i, wait, err)
+				}
+				continue
+			}
+			ok, err := l.Allow(ctx, "user:1")
+			if err != nil || ok != st.allowed {
+				t.Fatalf("%v step %d: allow=%v err=%v", name, i, ok, err)
+			}
+		}
+		if ok, err := l.Allow(ctx, "user:2"); err != nil || !ok {
+			t.Fatalf("%v: other key allow=%v err=%v", name, ok, err)
+		}
+	}
+
+	// 每秒 10 个，最多积累 2 个
+	tokenBucket := []step{
+		{allowed: true},
+		{allowed: true},
+		{allowed: false},
+		{advance: 100 * time.Millisecond, allowed: true},
+		{reserve: true, wait: 100 * time.Millisecond},
+		{reserve: true, wait: 200 * time.Millisecond},
+		{allowed: false},
+		{advance: 300 * time.Millisecond, allowed: true},
+		{allowed: false},
+	}
+	redisTB := NewRedisTokenBucket("default", 10, 2)
+	redisTB.now = clock
+	run("redis token bucket", redisTB, tokenBucket)
+	memoryTB := NewMemoryTokenBucket(10, 2)
+	memoryTB.now = clock
+	run("memory token bucket", memoryTB, tokenBucket)
+
+	// 每秒最多 2 次
+	slidingWindow := []step{
+		{allowed: true},
+		{allowed: true},
+		{allowed: false},
+		{advance: 500 * time.Millisecond, allowed: false},
+		{reserve: true, wait: 500 * time.Millisecond},
+		{reserve: true, wait: 500 * time.Millisecond},
+		{advance: 600 * time.Millisecond, allowed: false},
+		{advance: 900 * time.Millisecond, allowed: true},
+	}
+	redisSW := NewRedisSlidingWindow("default", 2, time.Second)
+	redisSW.now = clock
+	run("redis sliding window", redisSW, slidingWindow)
+	memorySW := NewMemorySlidingWindow(2, time.Second)
+	memorySW.now = clock
+	run("memory sliding window", memorySW, slidingWindow)
+
+	if s.TTL(redisSW.Prefix+"user:1") <= 0 || s.TTL(redisTB.Prefix+"user:1") <= 0 {
+		t.Fatal("limiter keys should expire")
+	}
+}
@@ -0,0 +1,184 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 未配置时的默认超时
+const (
+	defaultRedisConnTimeout  = 50 * time.Millisecond
+	defaultRedisReadTimeout  = 100 * time.Millisecond
+	defaultRedisWriteTimeout = 100 * time.Millisecond
+)
+
+// 未配置 max_idle 时保留的空闲连接数，redigo 的 MaxIdle 为 0 时每次都新建连接
+const defaultRedisMaxIdle = 10
+
+var RedisMapPool map[string]*redis.Pool
+var RedisDefaultPool *redis.Pool
+
+// 连接池对应的代理地址集合，用于查询健康状态
+var redisProxyMap map[string]*redisProxySet
+
+// 按 ConfRedisMap 创建连接池，每个 [list.<name>] 对应一个连接池
+// 创建后会 PING 检查连接，失败时关闭已创建的连接池并返回错误
+func InitRedisPool() error {
+	if ConfRedisMap == nil || len(ConfRedisMap.List) == 0 {
+		fmt.Printf("[WARN] %s %s\n", time.Now().Format(TimeFormat), " empty redis config.")
+	}
+
+	pools := map[string]*redis.Pool{}
+	proxies := map[string]*redisProxySet{}
+	if ConfRedisMap != nil {
+		for confName, conf := range ConfRedisMap.List {
+			proxy := newRedisProxySet(conf)
+			pool := newRedisPool(conf, proxy)
+			if err := pingRedisPool(pool); err != nil {
+				pool.Close()
+				for _, p := range pools {
+					p.Close()
+				}
+				return fmt.Errorf("redis [%v] ping fail. err=%v", confName, err)
+			}
+			pools[confName] = pool
+			proxies[confName] = proxy
+		}
+	}
+
+	CloseRedis()
+	RedisMapPool = pools
+	redisProxyMap = proxies
+	if pool, err := GetRedisPool("default"); err == nil {
+		RedisDefaultPool = pool
+	}
+	return nil
+}
+
+// 按配置创建连接池，新建连接时按 balance 在 proxy_list 中选择地址，见 redisProxySet
+func NewRedisPool(conf *RedisConf) *redis.Pool {
+	return newRedisPool(conf, newRedisProxySet(conf))
+}
+
+func newRedisPool(conf *RedisConf, proxy *redisProxySet) *redis.Pool {
+	maxIdle := conf.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = defaultRedisMaxIdle
+	}
+	return &redis.Pool{
+		MaxIdle:     maxIdle,
+		MaxActive:   conf.MaxActive,
+		IdleTimeout: time.Duration(conf.IdleTimeout) * time.Second,
+		Dial:        proxy.dial,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+func redisTimeout(ms int, def time.Duration) time.Duration {
+	if ms <= 0 {
+		return def
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func pingRedisPool(pool *redis.Pool) error {
+	c := pool.Get()
+	defer c.Close()
+	_, err := c.Do("PING")
+	return err
+}
+
+func GetRedisPool(name string) (*redis.Pool, error) {
+	if pool, ok := RedisMapPool[name]; ok {
+		return pool, nil
+	}
+	return nil, errors.New("get redis pool error")
+}
+
+// 关闭所有连接池，可重复调用
+func CloseRedis() error {
+	for _, pool := range RedisMapPool {
+		pool.Close()
+	}
+	RedisMapPool = map[string]*redis.Pool{}
+	RedisDefaultPool = nil
+	redisProxyMap = map[string]*redisProxySet{}
+	return nil
+}
+
+// 日志中单个参数的最大长度，超出部分截断
+var RedisLogArgMaxLen = 128
+
+// 在 name 对应的连接池上执行命令，并按 DLTagRedisSuccess/DLTagRedisFailed 记录日志
+func RedisLogDo(trace *TraceContext, name string, cmd string, args ...interface{}) (interface{}, error) {
+	if trace == nil {
+		trace = NewTrace()
+	}
+	startExecTime := time.Now()
+	reply, err := redisDo(name, cmd, args...)
+	endExecTime := time.Now()
+	if err != nil {
+		Log.TagError(trace, DLTagRedisFailed, map[string]interface{}{
+			"name":      name,
+			"method":    cmd,
+			"bind":      redisLogArgs(args),
+			"err":       err,
+			"proc_time": fmt.Sprintf("%f", endExecTime.Sub(startExecTime).Seconds()),
+		})
+	} else {
+		Log.TagInfo(trace, DLTagRedisSuccess, map[string]interface{}{
+			"name":      name,
+			"method":    cmd,
+			"bind":      redisLogArgs(args),
+			"proc_time": fmt.Sprintf("%f", endExecTime.Sub(startExecTime).Seconds()),
+		})
+	}
+	return reply, err
+}
+
+func redisDo(name string, cmd string, args ...interface{}) (interface{}, error) {
+	pool, err := GetRedisPool(name)
+	if err != nil {
+		return nil, err
+	}
+	c := pool.Get()
+	defer c.Close()
+	return c.Do(cmd, args...)
+}
+
+// 截断过长的参数
+func redisLogArgs(args []interface{}) []interface{} {
+	logArgs := make([]interface{}, len(args))
+	for i, arg := range args {
+		var s string
+		switch v := arg.(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		default:
+			logArgs[i] = arg
+			continue
+		}
+		if RedisLogArgMaxLen > 0 && len(s) > RedisLogArgMaxLen {
+			// 在字符边界截断，避免日志中出现不完整的 UTF-8 字符
+			n := RedisLogArgMaxLen
+			for n > 0 && !utf8.RuneStart(s[n]) {
+				n--
+			}
+			s = fmt.Sprintf("%s...(%d bytes)", s[:n], len(s))
+		}
+		logArgs[i] = s
+	}
+	return logArgs
+}
@@ -0,0 +1,211 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	ErrRedisLockHeld    = errors.New("redis lock already held")
+	ErrRedisLockNotHeld = errors.New("redis lock not held")
+)
+
+// 持有者 token 一致时才删除
+const redisUnlockScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+
+// 持有者 token 一致时才续期
+const redisRenewScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`
+
+// 基于 redis SET NX PX 的分布式锁，使用 redis_map 中 name 对应的连接池
+// 持有期间每 ttl/3 自动续期，进程异常退出时锁在 ttl 后自动释放
+// 同一个 RedisLock 不可重入，不同实例或进程之间通过 key 互斥
+// 续期发现锁已被删除或过期，或续期失败超过 ttl 时锁丢失，Lost 返回的 channel 被关闭
+type RedisLock struct {
+	Trace         *TraceContext
+	RetryInterval time.Duration // Lock 重试间隔，默认 50ms
+
+	name string
+	key  string
+	ttl  time.Duration
+
+	lock  sync.Mutex
+	token string
+	stop  chan struct{}
+	done  chan struct{}
+	lost  chan struct{}
+}
+
+func NewRedisLock(redisName string, key string, ttl time.Duration) *RedisLock {
+	return &RedisLock{
+		Trace:         NewTrace(),
+		RetryInterval: 50 * time.Millisecond,
+		name:          redisName,
+		key:           key,
+		ttl:           ttl,
+	}
+}
+
+// 尝试获取锁，已被其他持有者获取时返回 false
+func (l *RedisLock) TryLock() (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.token != "" && !l.isLost() {
+		return false, ErrRedisLockHeld
+	}
+	l.reset()
+
+	token, err := newRedisLockToken()
+	if err != nil {
+		return false, err
+	}
+	reply, err := redis.String(RedisLogDo(l.Trace, l.name, "SET", l.key, token, "NX", "PX", l.ttl.Milliseconds()))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if reply != "OK" {
+		return false, nil
+	}
+
+	l.token = token
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	l.lost = make(chan struct{})
+	go l.renew(token, l.stop, l.done, l.lost)
+	return true, nil
+}
+
+// 获取锁，直到成功或 ctx 结束
+func (l *RedisLock) Lock(ctx context.Context) error {
+	for {
+		ok, err := l.TryLock()
+		if err != nil || ok {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(l.RetryInterval):
+		}
+	}
+}
+
+// 释放锁，锁已过期或被其他持有者获取时返回 ErrRedisLockNotHeld
+func (l *RedisLock) Unlock() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.token == "" {
+		return ErrRedisLockNotHeld
+	}
+	if l.isLost() {
+		l.reset()
+		return ErrRedisLockNotHeld
+	}
+	token := l.token
+	l.reset()
+
+	n, err := redis.Int(RedisLogDo(l.Trace, l.name, "EVAL", redisUnlockScript, 1, l.key, token))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRedisLockNotHeld
+	}
+	return nil
+}
+
+// 持有锁时返回锁丢失或释放后关闭的 channel，持有者应在关闭后停止临界区内的操作
+// 未持有锁时返回已关闭的 channel
+func (l *RedisLock) Lost() <-chan struct{} {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.lost == nil {
+		lost := make(chan struct{})
+		close(lost)
+		return lost
+	}
+	return l.lost
+}
+
+// 调用方持有 l.lock
+func (l *RedisLock) isLost() bool {
+	select {
+	case <-l.lost:
+		return true
+	default:
+		return false
+	}
+}
+
+// 停止续期并清除持有状态，调用方持有 l.lock
+func (l *RedisLock) reset() {
+	if l.token == "" {
+		return
+	}
+	close(l.stop)
+	<-l.done
+	if !l.isLost() {
+		close(l.lost)
+	}
+	l.token, l.stop, l.done, l.lost = "", nil, nil, nil
+}
+
+// 持有期间定时续期，锁已被删除或过期，或者连续续期失败超过 ttl 时关闭 lost 并停止
+func (l *RedisLock) renew(token string, stop, done, lost chan struct{}) {
+	defer close(done)
+	interval := l.ttl / 3
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			n, err := redis.Int(RedisLogDo(l.Trace, l.name, "EVAL", redisRenewScript, 1, l.key, token, l.ttl.Milliseconds()))
+			if err == nil && n > 0 {
+				renewed = time.Now()
+				continue
+			}
+			if err == nil {
+				err = ErrRedisLockNotHeld
+			} else if time.Since(renewed) < l.ttl {
+				continue
+			}
+			Log.TagWarn(l.Trace, DLTagRedisFailed, map[string]interface{}{
+				"method": "lock_renew",
+				"key":    l.key,
+				"err":    err,
+			})
+			close(lost)
+			return
+		}
+	}
+}
+
+func newRedisLockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
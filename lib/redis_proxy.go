@@ -0,0 +1,256 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	RedisBalanceRoundRobin = "round_robin"
+	RedisBalanceRandom     = "random"
+
+	defaultRedisMaxFails    = 3
+	defaultRedisFailTimeout = 10 * time.Second
+)
+
+// 代理地址的健康状态
+type RedisProxyStatus struct {
+	Addr         string
+	Healthy      bool
+	Fails        int       // 连续失败次数
+	EjectedUntil time.Time // 摘除到期时间，到期后下次建连时 PING 探测
+	LastError    string
+}
+
+// 获取 name 连接池各代理地址的健康状态
+func GetRedisProxyStatus(name string) ([]RedisProxyStatus, error) {
+	proxy, ok := redisProxyMap[name]
+	if !ok {
+		return nil, errors.New("get redis pool error")
+	}
+	return proxy.status(), nil
+}
+
+// proxy_list 中的地址集合
+//
+// 新建连接时按 balance 选择起始地址，失败时依次尝试下一个
+// 建连或命令的网络错误连续达到 max_fails 次的地址摘除 fail_timeout，
+// 到期后再次被选中时建连并 PING 成功才恢复，所有地址都被摘除时仍逐个尝试
+type redisProxySet struct {
+	conf        *RedisConf
+	maxFails    int
+	failTimeout time.Duration
+
+	lock   sync.Mutex
+	next   int
+	proxys []*redisProxy
+}
+
+type redisProxy struct {
+	addr         string
+	fails        int
+	ejectedUntil time.Time
+	lastErr      error
+}
+
+func newRedisProxySet(conf *RedisConf) *redisProxySet {
+	s := &redisProxySet{
+		conf:        conf,
+		maxFails:    conf.MaxFails,
+		failTimeout: redisTimeout(conf.FailTimeout, defaultRedisFailTimeout),
+	}
+	if s.maxFails <= 0 {
+		s.maxFails = defaultRedisMaxFails
+	}
+	for _, addr := range conf.ProxyList {
+		s.proxys = append(s.proxys, &redisProxy{addr: addr})
+	}
+	return s
+}
+
+// 建连候选地址
+type redisProxyPick struct {
+	addr  string
+	probe bool // 摘除到期，需要 PING 探测
+}
+
+// 按负载均衡策略排列候选地址，未摘除的在前，摘除中的在最后
+func (s *redisProxySet) pick() []redisProxyPick {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n := len(s.proxys)
+	if n == 0 {
+		return nil
+	}
+	var start int
+	if s.conf.Balance == RedisBalanceRandom {
+		start = rand.Intn(n)
+	} else {
+		start = s.next % n
+		s.next = (start + 1) % n
+	}
+
+	now := time.Now()
+	picks := make([]redisProxyPick, 0, n)
+	var ejected []redisProxyPick
+	for i := 0; i < n; i++ {
+		p := s.proxys[(start+i)%n]
+		switch {
+		case p.ejectedUntil.IsZero():
+			picks = append(picks, redisProxyPick{addr: p.addr})
+		case now.After(p.ejectedUntil):
+			picks = append(picks, redisProxyPick{addr: p.addr, probe: true})
+		default:
+			ejected = append(ejected, redisProxyPick{addr: p.addr, probe: true})
+		}
+	}
+	return append(picks, ejected...)
+}
+
+// 新建连接，作为 redis.Pool 的 Dial
+func (s *redisProxySet) dial() (redis.Conn, error) {
+	picks := s.pick()
+	if len(picks) == 0 {
+		return nil, errors.New("empty redis proxy_list")
+	}
+	connTimeout := redisTimeout(s.conf.ConnTimeout, defaultRedisConnTimeout)
+	readTimeout := redisTimeout(s.conf.ReadTimeout, defaultRedisReadTimeout)
+	writeTimeout := redisTimeout(s.conf.WriteTimeout, defaultRedisWriteTimeout)
+
+	var lastErr error
+	for _, pick := range picks {
+		c, err := redis.Dial("tcp", pick.addr,
+			redis.DialConnectTimeout(connTimeout),
+			redis.DialReadTimeout(readTimeout),
+			redis.DialWriteTimeout(writeTimeout),
+			redis.DialPassword(s.conf.Password),
+			redis.DialDatabase(s.conf.Db),
+		)
+		if err == nil && pick.probe {
+			if _, err = c.Do("PING"); err != nil {
+				c.Close()
+			}
+		}
+		if err != nil {
+			s.fail(pick.addr, err)
+			lastErr = fmt.Errorf("dial [%v] fail. err=%v", pick.addr, err)
+			continue
+		}
+		s.success(pick.addr)
+		return &redisProxyConn{Conn: c, addr: pick.addr, set: s}, nil
+	}
+	return nil, lastErr
+}
+
+func (s *redisProxySet) find(addr string) *redisProxy {
+	for _, p := range s.proxys {
+		if p.addr == addr {
+			return p
+		}
+	}
+	return nil
+}
+
+// 记录失败，连续失败达到 maxFails 时摘除
+func (s *redisProxySet) fail(addr string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p := s.find(addr)
+	if p == nil {
+		return
+	}
+	p.fails++
+	p.lastErr = err
+	if p.fails >= s.maxFails {
+		if p.ejectedUntil.IsZero() {
+			fmt.Printf("[WARN] %s redis proxy [%v] ejected. fails=%d err=%v\n", time.Now().Format(TimeFormat), addr, p.fails, err)
+		}
+		p.ejectedUntil = time.Now().Add(s.failTimeout)
+	}
+}
+
+// 记录成功，清除失败次数并恢复摘除的地址
+func (s *redisProxySet) success(addr string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p := s.find(addr)
+	if p == nil || (p.fails == 0 && p.ejectedUntil.IsZero()) {
+		return
+	}
+	if !p.ejectedUntil.IsZero() {
+		fmt.Printf("[INFO] %s redis proxy [%v] recovered.\n", time.Now().Format(TimeFormat), addr)
+	}
+	p.fails = 0
+	p.ejectedUntil = time.Time{}
+}
+
+func (s *redisProxySet) status() []RedisProxyStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	list := make([]RedisProxyStatus, 0, len(s.proxys))
+	for _, p := range s.proxys {
+		st := RedisProxyStatus{
+			Addr:         p.addr,
+			Healthy:      p.ejectedUntil.IsZero(),
+			Fails:        p.fails,
+			EjectedUntil: p.ejectedUntil,
+		}
+		if p.lastErr != nil {
+			st.LastError = p.lastErr.Error()
+		}
+		list = append(list, st)
+	}
+	return list
+}
+
+// 记录命令网络错误的连接，redis 返回的错误不计入失败
+// 网络错误后连接不再可用，每个连接只记录第一次
+type redisProxyConn struct {
+	redis.Conn
+	addr   string
+	set    *redisProxySet
+	failed int32
+}
+
+func (c *redisProxyConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(cmd, args...)
+	c.record(err)
+	return reply, err
+}
+
+func (c *redisProxyConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	c.record(err)
+	return reply, err
+}
+
+func (c *redisProxyConn) record(err error) {
+	if err == nil {
+		return
+	}
+	if _, ok := err.(redis.Error); ok {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&c.failed, 0, 1) {
+		c.set.fail(c.addr, err)
+	}
+}
+
+func (c *redisProxyConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := redis.DoWithTimeout(c.Conn, timeout, cmd, args...)
+	c.record(err)
+	return reply, err
+}
+
+func (c *redisProxyConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	reply, err := redis.ReceiveWithTimeout(c.Conn, timeout)
+	c.record(err)
+	return reply, err
+}
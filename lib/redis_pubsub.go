@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	// 连接断开后的重连间隔，连续失败时加倍，最长 RedisReconnectMaxInterval
+	RedisReconnectInterval    = time.Second
+	RedisReconnectMaxInterval = 30 * time.Second
+	// 订阅连接的 PING 间隔，超过 2 倍间隔没有收到任何回复时重连
+	RedisPubSubHealthCheck = 30 * time.Second
+)
+
+// 收到订阅消息时调用，每条消息使用新的 trace
+type RedisMessageHandler func(trace *TraceContext, channel string, data []byte)
+
+// 订阅 channels，收到消息时调用 handler，阻塞直到 ctx 结束
+// 连接断开时重新从 pool 获取连接并订阅，pool 新建连接时会跳过失败的代理地址
+func RedisSubscribe(ctx context.Context, pool *redis.Pool, channels []string, handler RedisMessageHandler) error {
+	if len(channels) == 0 {
+		return errors.New("empty redis channels")
+	}
+	backoff := &redisBackoff{}
+	for {
+		err := redisSubscribeOnce(ctx, pool, channels, handler, backoff)
+		if ctx.Err() != nil {
+			return nil
+		}
+		Log.TagError(NewTrace(), DLTagRedisFailed, map[string]interface{}{
+			"method":   "SUBSCRIBE",
+			"channels": channels,
+			"err":      err,
+		})
+		if !backoff.wait(ctx) {
+			return nil
+		}
+	}
+}
+
+func redisSubscribeOnce(ctx context.Context, pool *redis.Pool, channels []string, handler RedisMessageHandler, backoff *redisBackoff) error {
+	psc := redis.PubSubConn{Conn: pool.Get()}
+	defer psc.Close()
+
+	args := make([]interface{}, len(channels))
+	for i, channel := range channels {
+		args[i] = channel
+	}
+	if err := psc.Subscribe(args...); err != nil {
+		return err
+	}
+
+	// 定时 PING，ctx 结束时取消订阅
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	defer wg.Wait()
+	defer close(done)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(RedisPubSubHealthCheck)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := psc.Ping(""); err != nil {
+					return
+				}
+			case <-ctx.Done():
+				psc.Unsubscribe()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		switch v := psc.ReceiveWithTimeout(2 * RedisPubSubHealthCheck).(type) {
+		case redis.Message:
+			handleRedisMessage(v, handler)
+		case redis.Subscription:
+			if v.Count == 0 {
+				return nil
+			}
+			if v.Kind == "subscribe" && v.Count == len(channels) {
+				backoff.reset()
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+func handleRedisMessage(msg redis.Message, handler RedisMessageHandler) {
+	trace := NewTrace()
+	startExecTime := time.Now()
+	defer func() {
+		if err := recover(); err != nil {
+			Log.TagError(trace, DLTagRedisFailed, map[string]interface{}{
+				"method":  "message",
+				"channel": msg.Channel,
+				"err":     fmt.Sprintf("handler panic=%v", err),
+			})
+		}
+	}()
+	handler(trace, msg.Channel, msg.Data)
+	Log.TagInfo(trace, DLTagRedisSuccess, map[string]interface{}{
+		"method":    "message",
+		"channel":   msg.Channel,
+		"proc_time": fmt.Sprintf("%f", time.Since(startExecTime).Seconds()),
+	})
+}
+
+// 重连退避
+type redisBackoff struct {
+	interval time.Duration
+}
+
+func (b *redisBackoff) reset() {
+	b.interval = 0
+}
+
+// 等待重连，ctx 结束时返回 false
+func (b *redisBackoff) wait(ctx context.Context) bool {
+	if b.interval == 0 {
+		b.interval = RedisReconnectInterval
+	} else if b.interval *= 2; b.interval > RedisReconnectMaxInterval {
+		b.interval = RedisReconnectMaxInterval
+	}
+
+	timer := time.NewTimer(b.interval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
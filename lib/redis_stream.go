@@ -0,0 +1,357 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 消息中保存 trace 的字段，消费时还原到 RedisStreamMessage.Trace
+const (
+	redisStreamTraceIdField = "_traceid"
+	redisStreamSpanIdField  = "_spanid"
+)
+
+// stream 中的一条消息
+type RedisStreamMessage struct {
+	Stream string
+	ID     string
+	Values map[string]string
+	Trace  *TraceContext // 使用生产者的 trace id
+}
+
+// 处理消息，返回 nil 时确认消息，返回错误时消息留在 pending 列表中，超过 MinIdle 后重新处理
+type RedisStreamHandler func(msg *RedisStreamMessage) error
+
+// 向 name 连接池的 stream 写入消息，消息中附带 trace，返回消息 ID
+func RedisStreamAdd(trace *TraceContext, name string, stream string, values map[string]interface{}) (string, error) {
+	if trace == nil {
+		trace = NewTrace()
+	}
+	child := *trace
+	child.CSpanId = NewSpanId()
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := []interface{}{stream, "*", redisStreamTraceIdField, child.TraceId, redisStreamSpanIdField, child.CSpanId}
+	for _, key := range keys {
+		args = append(args, key, values[key])
+	}
+	return redis.String(RedisLogDo(&child, name, "XADD", args...))
+}
+
+// stream 消费组的消费者
+//
+// Run 启动时先处理本消费者未确认的消息，然后阻塞读取新消息，
+// 每隔 ClaimInterval 按 Count 分页遍历 pending 列表，认领其他消费者超过 MinIdle 未确认的消息，已删除的消息直接确认
+// 连接断开时重新从 pool 获取连接，pool 新建连接时会跳过失败的代理地址
+type RedisStreamConsumer struct {
+	Stream   string
+	Group    string
+	Consumer string
+
+	StartID       string        // 创建消费组时的起始消息 ID，默认 $ 只消费新消息
+	Count         int           // 每次读取的消息数，默认 10
+	Block         time.Duration // 读取新消息的阻塞时间，默认 1s，ctx 结束后最多等待该时间返回
+	MinIdle       time.Duration // 默认 1 分钟
+	ClaimInterval time.Duration // 默认 30s
+
+	pool *redis.Pool
+}
+
+func NewRedisStreamConsumer(pool *redis.Pool, stream string, group string, consumer string) *RedisStreamConsumer {
+	return &RedisStreamConsumer{
+		Stream:        stream,
+		Group:         group,
+		Consumer:      consumer,
+		StartID:       "$",
+		Count:         10,
+		Block:         time.Second,
+		MinIdle:       time.Minute,
+		ClaimInterval: 30 * time.Second,
+		pool:          pool,
+	}
+}
+
+// 消费消息，阻塞直到 ctx 结束
+func (c *RedisStreamConsumer) Run(ctx context.Context, handler RedisStreamHandler) error {
+	backoff := &redisBackoff{}
+	for {
+		err := c.run(ctx, handler, backoff)
+		if ctx.Err() != nil {
+			return nil
+		}
+		Log.TagError(NewTrace(), DLTagRedisFailed, map[string]interface{}{
+			"method":   "XREADGROUP",
+			"stream":   c.Stream,
+			"group":    c.Group,
+			"consumer": c.Consumer,
+			"err":      err,
+		})
+		if !backoff.wait(ctx) {
+			return nil
+		}
+	}
+}
+
+func (c *RedisStreamConsumer) run(ctx context.Context, handler RedisStreamHandler, backoff *redisBackoff) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	if err := c.createGroup(conn); err != nil {
+		return err
+	}
+	// 本消费者未确认的消息，处理失败的消息留给 claim 重试
+	for id := "0"; ctx.Err() == nil; {
+		msgs, err := c.read(conn, id)
+		if err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		if err := c.handle(conn, msgs, handler); err != nil {
+			return err
+		}
+		id = msgs[len(msgs)-1].ID
+	}
+	backoff.reset()
+
+	lastClaim := time.Now()
+	for ctx.Err() == nil {
+		if time.Since(lastClaim) >= c.ClaimInterval {
+			lastClaim = time.Now()
+			// 按 Count 分页遍历 pending 列表
+			for start := "-"; start != "" && ctx.Err() == nil; {
+				msgs, next, err := c.claim(conn, start)
+				if err != nil {
+					return err
+				}
+				if err := c.handle(conn, msgs, handler); err != nil {
+					return err
+				}
+				start = next
+			}
+		}
+		msgs, err := c.read(conn, ">")
+		if err != nil {
+			return err
+		}
+		if err := c.handle(conn, msgs, handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 创建消费组，已存在时忽略
+func (c *RedisStreamConsumer) createGroup(conn redis.Conn) error {
+	_, err := conn.Do("XGROUP", "CREATE", c.Stream, c.Group, c.StartID, "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+// id 为 > 时阻塞读取新消息，否则读取本消费者 id 之后未确认的消息
+func (c *RedisStreamConsumer) read(conn redis.Conn, id string) ([]*RedisStreamMessage, error) {
+	reply, err := redis.DoWithTimeout(conn, c.Block+time.Second, "XREADGROUP", "GROUP", c.Group, c.Consumer,
+		"COUNT", c.Count, "BLOCK", c.Block.Milliseconds(), "STREAMS", c.Stream, id)
+	if err == redis.ErrNil || (err == nil && reply == nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	streams, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*RedisStreamMessage
+	for _, s := range streams {
+		pair, err := redis.Values(s, nil)
+		if err != nil || len(pair) != 2 {
+			return nil, fmt.Errorf("invalid XREADGROUP reply. err=%v", err)
+		}
+		entries, err := parseRedisStreamEntries(c.Stream, pair[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, entries...)
+	}
+	return msgs, nil
+}
+
+// 认领 pending 列表中从 start 开始的 Count 条里超过 MinIdle 未确认的消息，返回下一页的起始 ID，没有下一页时为空
+func (c *RedisStreamConsumer) claim(conn redis.Conn, start string) ([]*RedisStreamMessage, string, error) {
+	pending, err := redis.Values(conn.Do("XPENDING", c.Stream, c.Group, start, "+", c.Count))
+	if err == redis.ErrNil {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var ids []string
+	var next string
+	for i, p := range pending {
+		// [id, consumer, idle, delivery count]
+		entry, err := redis.Values(p, nil)
+		if err != nil || len(entry) < 3 {
+			return nil, "", fmt.Errorf("invalid XPENDING reply. err=%v", err)
+		}
+		id, _ := redis.String(entry[0], nil)
+		idle, _ := redis.Int64(entry[2], nil)
+		if time.Duration(idle)*time.Millisecond >= c.MinIdle {
+			ids = append(ids, id)
+		}
+		if i == len(pending)-1 && len(pending) >= c.Count {
+			if next, err = nextRedisStreamID(id); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil, next, nil
+	}
+
+	// 先只认领 ID，已被其他消费者认领的消息不会返回
+	args := []interface{}{c.Stream, c.Group, c.Consumer, c.MinIdle.Milliseconds()}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	ids, err = redis.Strings(conn.Do("XCLAIM", append(args, "JUSTID")...))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(ids) == 0 {
+		return nil, next, nil
+	}
+	// 再读取已认领的消息，返回结果与 ids 一一对应，已删除的消息为 nil
+	args = []interface{}{c.Stream, c.Group, c.Consumer, 0}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	reply, err := conn.Do("XCLAIM", args...)
+	if err != nil {
+		return nil, "", err
+	}
+	msgs, err := parseRedisStreamEntries(c.Stream, reply, ids)
+	return msgs, next, err
+}
+
+// stream 中 id 之后的最小 ID
+func nextRedisStreamID(id string) (string, error) {
+	parts := strings.SplitN(id, "-", 2)
+	ms, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 {
+		return "", fmt.Errorf("invalid stream id %q", id)
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid stream id %q", id)
+	}
+	if seq == math.MaxUint64 {
+		return fmt.Sprintf("%d-0", ms+1), nil
+	}
+	return fmt.Sprintf("%d-%d", ms, seq+1), nil
+}
+
+// 依次处理消息，处理成功的消息确认
+func (c *RedisStreamConsumer) handle(conn redis.Conn, msgs []*RedisStreamMessage, handler RedisStreamHandler) error {
+	for _, msg := range msgs {
+		// 已被删除的消息直接确认
+		if msg.Values != nil {
+			if err := c.handleMessage(msg, handler); err != nil {
+				continue
+			}
+		}
+		if _, err := conn.Do("XACK", c.Stream, c.Group, msg.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *RedisStreamConsumer) handleMessage(msg *RedisStreamMessage, handler RedisStreamHandler) (err error) {
+	startExecTime := time.Now()
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("handler panic=%v", e)
+		}
+		fields := map[string]interface{}{
+			"method":    "XREADGROUP",
+			"stream":    c.Stream,
+			"group":     c.Group,
+			"consumer":  c.Consumer,
+			"id":        msg.ID,
+			"proc_time": fmt.Sprintf("%f", time.Since(startExecTime).Seconds()),
+		}
+		if err != nil {
+			fields["err"] = err
+			Log.TagError(msg.Trace, DLTagRedisFailed, fields)
+		} else {
+			Log.TagInfo(msg.Trace, DLTagRedisSuccess, fields)
+		}
+	}()
+	return handler(msg)
+}
+
+// 解析 [[id, [field, value, ...]], ...]，已删除的消息 Values 为 nil
+// XCLAIM 对已删除的消息返回 nil，ids 与 entries 一一对应时按 ids 返回 Values 为 nil 的消息以便确认，否则跳过
+func parseRedisStreamEntries(stream string, reply interface{}, ids []string) ([]*RedisStreamMessage, error) {
+	entries, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*RedisStreamMessage, 0, len(entries))
+	for i, e := range entries {
+		if e == nil {
+			if len(ids) == len(entries) {
+				msgs = append(msgs, &RedisStreamMessage{Stream: stream, ID: ids[i]})
+			}
+			continue
+		}
+		entry, err := redis.Values(e, nil)
+		if err != nil || len(entry) != 2 {
+			return nil, errors.New("invalid stream entry")
+		}
+		msg := &RedisStreamMessage{Stream: stream}
+		if msg.ID, err = redis.String(entry[0], nil); err != nil {
+			return nil, err
+		}
+		if entry[1] != nil {
+			fields, err := redis.StringMap(entry[1], nil)
+			if err != nil {
+				return nil, err
+			}
+			msg.Values = fields
+		}
+		msg.Trace = streamMessageTrace(msg.Values)
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// 从消息字段中还原 trace 并移除 trace 字段，没有时新建
+func streamMessageTrace(values map[string]string) *TraceContext {
+	traceId, spanId := values[redisStreamTraceIdField], values[redisStreamSpanIdField]
+	delete(values, redisStreamTraceIdField)
+	delete(values, redisStreamSpanIdField)
+	if traceId == "" {
+		return NewTrace()
+	}
+	trace := &TraceContext{}
+	trace.TraceId = traceId
+	trace.SpanId = spanId
+	return trace
+}
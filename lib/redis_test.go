@@ -0,0 +1,545 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+// 启动测试用 redis
+func startTestRedis(t *testing.T) *miniredis.Miniredis {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// 测试按 redis_map 创建连接池
+func TestRedisPool(t *testing.T) {
+	s := startTestRedis(t)
+	defer s.Close()
+	s.RequireAuth("secret")
+
+	root := setupTestConf(t, map[string]string{
+		"redis_map.toml": `
+[list.default]
+proxy_list = ["127.0.0.1:1", "` + s.Addr() + `"]
+password = "secret"
+db = 3
+conn_timeout = 20
+[list.cache]
+proxy_list = ["` + s.Addr() + `"]
+password = "secret"
+max_idle = 2
+`,
+	})
+	defer os.RemoveAll(root)
+
+	if err := InitRedisConf(GetConfPath("redis_map")); err != nil {
+		t.Fatal(err)
+	}
+	if ConfRedis == nil || ConfRedis.Db != 3 || len(ConfRedisMap.List) != 2 {
+		t.Fatalf("redis conf=%+v", ConfRedisMap.List)
+	}
+	if err := InitRedisPool(); err != nil {
+		t.Fatal(err)
+	}
+	defer CloseRedis()
+
+	// 第一个地址不可用时使用下一个
+	c := RedisDefaultPool.Get()
+	if _, err := c.Do("SET", "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	s.Select(3)
+	if v, _ := s.Get("k"); v != "v" {
+		t.Fatalf("db 3 k=%v", v)
+	}
+
+	pool, err := GetRedisPool("cache")
+	if err != nil || pool.MaxIdle != 2 {
+		t.Fatalf("cache pool=%v err=%v", pool, err)
+	}
+	if _, err := GetRedisPool("missing"); err == nil {
+		t.Fatal("expect missing pool error")
+	}
+
+	// 连接失败时返回错误，不替换已有连接池
+	ConfRedisMap.List["bad"] = &RedisConf{ProxyList: []string{"127.0.0.1:1"}}
+	if err := InitRedisPool(); err == nil {
+		t.Fatal("expect ping error")
+	}
+	if RedisDefaultPool == nil {
+		t.Fatal("default pool should be kept")
+	}
+	c = RedisDefaultPool.Get()
+	if v, err := redis.String(c.Do("GET", "k")); err != nil || v != "v" {
+		t.Fatalf("get k=%v err=%v", v, err)
+	}
+	c.Close()
+
+	CloseRedis()
+	if RedisDefaultPool != nil || len(RedisMapPool) != 0 {
+		t.Fatal("pools should be reset")
+	}
+}
+
+// 测试带日志的 redis 命令
+func TestRedisLogDo(t *testing.T) {
+	s := startTestRedis(t)
+	defer s.Close()
+	ConfRedisMap = &RedisMapConf{List: map[string]*RedisConf{
+		"default": {ProxyList: []string{s.Addr()}},
+	}}
+	if err := InitRedisPool(); err != nil {
+		t.Fatal(err)
+	}
+	defer CloseRedis()
+
+	trace := NewTrace()
+	if _, err := RedisLogDo(trace, "default", "SET", "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := redis.String(RedisLogDo(trace, "default", "GET", "k")); err != nil || v != "v" {
+		t.Fatalf("get k=%v err=%v", v, err)
+	}
+	if _, err := RedisLogDo(nil, "default", "NOSUCHCMD"); err == nil {
+		t.Fatal("expect command error")
+	}
+	if _, err := RedisLogDo(trace, "missing", "GET", "k"); err == nil {
+		t.Fatal("expect missing pool error")
+	}
+
+	args := redisLogArgs([]interface{}{strings.Repeat("a", RedisLogArgMaxLen+10), []byte("b"), 3})
+	if s := args[0].(string); !strings.HasSuffix(s, fmt.Sprintf("...(%d bytes)", RedisLogArgMaxLen+10)) || len(s) > RedisLogArgMaxLen+20 {
+		t.Fatalf("truncated arg=%v", s)
+	}
+	if args[1] != "b" || args[2] != 3 {
+		t.Fatalf("args=%v", args)
+	}
+	// 多字节字符不被截断
+	args = redisLogArgs([]interface{}{"a" + strings.Repeat("中", RedisLogArgMaxLen)})
+	if s := args[0].(string); !utf8.ValidString(s) || !strings.HasSuffix(s, fmt.Sprintf("中...(%d bytes)", 1+3*RedisLogArgMaxLen)) {
+		t.Fatalf("truncated arg=%v", s)
+	}
+}
+
+// 测试代理地址失败摘除和恢复
+func TestRedisProxyFailover(t *testing.T) {
+	s1 := startTestRedis(t)
+	defer s1.Close()
+	s2 := startTestRedis(t)
+	defer s2.Close()
+	ConfRedisMap = &RedisMapConf{List: map[string]*RedisConf{
+		"default": {ProxyList: []string{s1.Addr(), s2.Addr()}, MaxFails: 2, FailTimeout: 100},
+		"random":  {ProxyList: []string{s1.Addr(), s2.Addr()}, Balance: RedisBalanceRandom},
+	}}
+	if err := InitRedisPool(); err != nil {
+		t.Fatal(err)
+	}
+	defer CloseRedis()
+
+	// 不复用连接，每次执行命令都新建连接
+	for _, pool := range RedisMapPool {
+		pool.MaxIdle = 0
+	}
+	do := func(name string, n int) {
+		for i := 0; i < n; i++ {
+			if _, err := RedisLogDo(nil, name, "PING"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	do("default", 2)
+	if s1.TotalConnectionCount() == 0 || s2.TotalConnectionCount() == 0 {
+		t.Fatalf("round robin connections=%d %d", s1.TotalConnectionCount(), s2.TotalConnectionCount())
+	}
+	do("random", 4)
+
+	addr2 := s2.Addr()
+	s2.Close()
+	do("default", 4)
+	status, err := GetRedisProxyStatus("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status[0].Healthy || status[1].Healthy || status[1].Fails != 2 || status[1].LastError == "" {
+		t.Fatalf("status=%+v", status)
+	}
+	// 摘除期间不再尝试
+	do("default", 4)
+	if status, _ := GetRedisProxyStatus("default"); status[1].Fails != 2 {
+		t.Fatalf("status=%+v", status)
+	}
+
+	if err := s2.StartAddr(addr2); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	do("default", 2)
+	if status, _ := GetRedisProxyStatus("default"); !status[1].Healthy || status[1].Fails != 0 {
+		t.Fatalf("status=%+v", status)
+	}
+	if _, err := GetRedisProxyStatus("missing"); err == nil {
+		t.Fatal("expect missing pool error")
+	}
+}
+
+// 测试分布式锁
+func TestRedisLock(t *testing.T) {
+	s := startTestRedis(t)
+	defer s.Close()
+	ConfRedisMap = &RedisMapConf{List: map[string]*RedisConf{
+		"default": {ProxyList: []string{s.Addr()}},
+	}}
+	if err := InitRedisPool(); err != nil {
+		t.Fatal(err)
+	}
+	defer CloseRedis()
+
+	l1 := NewRedisLock("default", "lock:job", 300*time.Millisecond)
+	l2 := NewRedisLock("default", "lock:job", 300*time.Millisecond)
+	if ok, err := l1.TryLock(); err != nil || !ok {
+		t.Fatalf("l1 lock=%v err=%v", ok, err)
+	}
+	if _, err := l1.TryLock(); err != ErrRedisLockHeld {
+		t.Fatalf("l1 relock err=%v", err)
+	}
+	if ok, err := l2.TryLock(); err != nil || ok {
+		t.Fatalf("l2 lock=%v err=%v", ok, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := l2.Lock(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("l2 lock err=%v", err)
+	}
+
+	// 持有期间自动续期
+	s.FastForward(200 * time.Millisecond)
+	time.Sleep(150 * time.Millisecond)
+	if ttl := s.TTL("lock:job"); ttl != 300*time.Millisecond {
+		t.Fatalf("ttl=%v", ttl)
+	}
+
+	// 释放后其他持有者可以获取
+	done := make(chan error, 1)
+	go func() {
+		done <- l2.Lock(context.Background())
+	}()
+	if err := l1.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := l1.Unlock(); err != ErrRedisLockNotHeld {
+		t.Fatalf("l1 unlock again err=%v", err)
+	}
+
+	// 锁已丢失时不会删除其他持有者的锁
+	s.Set("lock:job", "other")
+	if err := l2.Unlock(); err != ErrRedisLockNotHeld {
+		t.Fatalf("l2 unlock err=%v", err)
+	}
+	if v, _ := s.Get("lock:job"); v != "other" {
+		t.Fatalf("lock:job=%v", v)
+	}
+	select {
+	case <-l2.Lost():
+	default:
+		t.Fatal("lost not closed after unlock")
+	}
+}
+
+// 测试持有期间锁过期
+func TestRedisLockLost(t *testing.T) {
+	s := startTestRedis(t)
+	defer s.Close()
+	ConfRedisMap = &RedisMapConf{List: map[string]*RedisConf{
+		"default": {ProxyList: []string{s.Addr()}},
+	}}
+	if err := InitRedisPool(); err != nil {
+		t.Fatal(err)
+	}
+	defer CloseRedis()
+
+	l := NewRedisLock("default", "lock:lost", 300*time.Millisecond)
+	if ok, err := l.TryLock(); err != nil || !ok {
+		t.Fatalf("lock=%v err=%v", ok, err)
+	}
+	lost := l.Lost()
+	select {
+	case <-lost:
+		t.Fatal("lost closed while held")
+	default:
+	}
+
+	// 续期前锁已过期
+	s.FastForward(time.Second)
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatal("lost not closed after expire")
+	}
+
+	// 丢失后可以重新获取
+	if ok, err := l.TryLock(); err != nil || !ok {
+		t.Fatalf("relock=%v err=%v", ok, err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 测试订阅和断线重连
+func TestRedisSubscribe(t *testing.T) {
+	s := startTestRedis(t)
+	defer s.Close()
+	ConfRedisMap = &RedisMapConf{List: map[string]*RedisConf{
+		"default": {ProxyList: []string{s.Addr()}},
+	}}
+	if err := InitRedisPool(); err != nil {
+		t.Fatal(err)
+	}
+	defer CloseRedis()
+	defer func(d time.Duration) { RedisReconnectInterval = d }(RedisReconnectInterval)
+	RedisReconnectInterval = 10 * time.Millisecond
+
+	received := make(chan string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- RedisSubscribe(ctx, RedisDefaultPool, []string{"news"}, func(trace *TraceContext, channel string, data []byte) {
+			if trace == nil || trace.TraceId == "" {
+				t.Errorf("empty trace")
+			}
+			received <- channel + ":" + string(data)
+		})
+	}()
+	publish := func(data string) {
+		deadline := time.Now().Add(2 * time.Second)
+		for s.Publish("news", data) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("subscribe timeout")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		if msg := <-received; msg != "news:"+data {
+			t.Fatalf("msg=%v", msg)
+		}
+	}
+	publish("a")
+
+	addr := s.Addr()
+	s.Close()
+	if err := s.StartAddr(addr); err != nil {
+		t.Fatal(err)
+	}
+	publish("b")
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 测试 stream 消费组，处理失败的消息超时后重新处理
+func TestRedisStreamConsumer(t *testing.T) {
+	s := startTestRedis(t)
+	defer s.Close()
+	ConfRedisMap = &RedisMapConf{List: map[string]*RedisConf{
+		"default": {ProxyList: []string{s.Addr()}},
+	}}
+	if err := InitRedisPool(); err != nil {
+		t.Fatal(err)
+	}
+	defer CloseRedis()
+
+	trace := NewTrace()
+	for _, id := range []string{"1", "2"} {
+		if _, err := RedisStreamAdd(trace, "default", "orders", map[string]interface{}{"order_id": id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	consumer := NewRedisStreamConsumer(RedisDefaultPool, "orders", "billing", "worker-1")
+	consumer.StartID = "0"
+	consumer.Block = 20 * time.Millisecond
+	consumer.MinIdle = 50 * time.Millisecond
+	consumer.ClaimInterval = 50 * time.Millisecond
+
+	handled := make(chan *RedisStreamMessage, 10)
+	var attempts int32
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- consumer.Run(ctx, func(msg *RedisStreamMessage) error {
+			if msg.Values["order_id"] == "1" && atomic.AddInt32(&attempts, 1) == 1 {
+				return errors.New("temporary failure")
+			}
+			handled <- msg
+			return nil
+		})
+	}()
+
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case msg := <-handled:
+			if msg.Trace.TraceId != trace.TraceId {
+				t.Fatalf("trace id=%v, want %v", msg.Trace.TraceId, trace.TraceId)
+			}
+			if _, ok := msg.Values[redisStreamTraceIdField]; ok {
+				t.Fatalf("values=%v", msg.Values)
+			}
+			got[msg.Values["order_id"]] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("handled=%v attempts=%d", got, atomic.LoadInt32(&attempts))
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Fatalf("attempts=%d", n)
+	}
+
+	c := RedisDefaultPool.Get()
+	defer c.Close()
+	pending, err := redis.Values(c.Do("XPENDING", "orders", "billing", "-", "+", 10))
+	if (err != nil && err != redis.ErrNil) || len(pending) != 0 {
+		t.Fatalf("pending=%v err=%v", pending, err)
+	}
+}
+
+// 测试认领超过 Count 条的 pending 消息，已删除的消息直接确认
+func TestRedisStreamClaim(t *testing.T) {
+	s := startTestRedis(t)
+	defer s.Close()
+	ConfRedisMap = &RedisMapConf{List: map[string]*RedisConf{
+		"default": {ProxyList: []string{s.Addr()}},
+	}}
+	if err := InitRedisPool(); err != nil {
+		t.Fatal(err)
+	}
+	defer CloseRedis()
+
+	c := RedisDefaultPool.Get()
+	defer c.Close()
+	var ids []string
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		msgId, err := RedisStreamAdd(NewTrace(), "default", "jobs", map[string]interface{}{"job_id": id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msgId)
+	}
+	// 其他消费者读取后未确认，其中一条被删除
+	if _, err := c.Do("XGROUP", "CREATE", "jobs", "workers", "0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Do("XREADGROUP", "GROUP", "workers", "worker-0", "STREAMS", "jobs", ">"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Do("XDEL", "jobs", ids[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	consumer := NewRedisStreamConsumer(RedisDefaultPool, "jobs", "workers", "worker-1")
+	consumer.Count = 2
+	consumer.Block = 20 * time.Millisecond
+	consumer.MinIdle = 50 * time.Millisecond
+	consumer.ClaimInterval = 50 * time.Millisecond
+
+	handled := make(chan string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- consumer.Run(ctx, func(msg *RedisStreamMessage) error {
+			handled <- msg.Values["job_id"]
+			return nil
+		})
+	}()
+
+	got := map[string]bool{}
+	for len(got) < 4 {
+		select {
+		case id := <-handled:
+			got[id] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("handled=%v", got)
+		}
+	}
+	if got["2"] {
+		t.Fatalf("handled=%v", got)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		pending, err := redis.Values(c.Do("XPENDING", "jobs", "workers", "-", "+", 10))
+		if (err == nil || err == redis.ErrNil) && len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pending=%v err=%v", pending, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNextRedisStreamID(t *testing.T) {
+	for id, want := range map[string]string{
+		"1-0":                    "1-1",
+		"1526919030474-55":       "1526919030474-56",
+		"5-18446744073709551615": "6-0",
+	} {
+		if next, err := nextRedisStreamID(id); err != nil || next != want {
+			t.Fatalf("id=%v next=%v err=%v", id, next, err)
+		}
+	}
+	if _, err := nextRedisStreamID("bad"); err == nil {
+		t.Fatal("want error")
+	}
+}
+
+// 测试未配置 max_idle 时复用连接
+func TestRedisPoolReuse(t *testing.T) {
+	s := startTestRedis(t)
+	defer s.Close()
+	ConfRedisMap = &RedisMapConf{List: map[string]*RedisConf{
+		"default": {ProxyList: []string{s.Addr()}},
+	}}
+	if err := InitRedisPool(); err != nil {
+		t.Fatal(err)
+	}
+	defer CloseRedis()
+
+	for i := 0; i < 50; i++ {
+		c := RedisDefaultPool.Get()
+		if _, err := c.Do("PING"); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	if n := s.TotalConnectionCount(); n != 1 {
+		t.Fatalf("total connections=%d", n)
+	}
+	if n := RedisDefaultPool.IdleCount(); n != 1 {
+		t.Fatalf("idle connections=%d", n)
+	}
+}
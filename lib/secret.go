@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// 配置文件中的加密值格式为 ENC(base64(nonce+密文))，加载配置时使用 AES-GCM 解密
+//
+// 密钥为 base64 编码的 16/24/32 字节，优先读取环境变量 ConfSecretKeyEnv，
+// 其次读取环境变量 ConfSecretKeyFileEnv 或 ConfSecretKeyFile 指定的密钥文件
+// 加密值可以用 cmd/confsecret 生成
+var (
+	ConfSecretKeyEnv     = "APP_CONF_SECRET_KEY"
+	ConfSecretKeyFileEnv = "APP_CONF_SECRET_KEY_FILE"
+	ConfSecretKeyFile    = ""
+)
+
+const (
+	confSecretPrefix = "ENC("
+	confSecretSuffix = ")"
+)
+
+// 判断配置值是否为加密值
+func IsConfSecret(value string) bool {
+	return strings.HasPrefix(value, confSecretPrefix) && strings.HasSuffix(value, confSecretSuffix)
+}
+
+// 读取配置解密密钥，未配置时返回 nil
+func LoadConfSecretKey() ([]byte, error) {
+	encoded := os.Getenv(ConfSecretKeyEnv)
+	if encoded == "" {
+		path := os.Getenv(ConfSecretKeyFileEnv)
+		if path == "" {
+			path = ConfSecretKeyFile
+		}
+		if path == "" {
+			return nil, nil
+		}
+		bts, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read secret key file [%v] fail. err=%v", path, err)
+		}
+		encoded = string(bts)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("decode secret key fail. err=%v", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("invalid secret key length %d, must be 16, 24 or 32 bytes", len(key))
+	}
+	return key, nil
+}
+
+// 生成 base64 编码的随机密钥
+func GenConfSecretKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// 加密配置值，返回 ENC(...) 格式
+func EncryptConfValue(plain string, key []byte) (string, error) {
+	gcm, err := newConfCipher(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plain), nil)
+	return confSecretPrefix + base64.StdEncoding.EncodeToString(sealed) + confSecretSuffix, nil
+}
+
+// 解密 ENC(...) 格式的配置值，非加密值原样返回
+func DecryptConfValue(value string, key []byte) (string, error) {
+	if !IsConfSecret(value) {
+		return value, nil
+	}
+	gcm, err := newConfCipher(key)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value[len(confSecretPrefix) : len(value)-len(confSecretSuffix)])
+	if err != nil {
+		return "", fmt.Errorf("decode secret fail. err=%v", err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("decrypt secret fail. ciphertext too short")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypt secret fail. err=%v", err)
+	}
+	return string(plain), nil
+}
+
+func newConfCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, errors.New("empty secret key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 解密 name 配置中所有 ENC(...) 格式的值
+// 存在加密值但未配置密钥时返回错误，返回解密的配置项
+func decryptConf(name string, v *viper.Viper) ([]string, error) {
+	var decrypted []string
+	var key []byte
+	var keyLoaded bool
+	decrypt := func(subKey string, value string) (string, error) {
+		if !keyLoaded {
+			k, err := LoadConfSecretKey()
+			if err != nil {
+				return "", err
+			}
+			if k == nil {
+				return "", fmt.Errorf("config [%v.%v] is encrypted but secret key not set. env=%v", name, subKey, ConfSecretKeyEnv)
+			}
+			key, keyLoaded = k, true
+		}
+		plain, err := DecryptConfValue(value, key)
+		if err != nil {
+			return "", fmt.Errorf("config [%v.%v] %v", name, subKey, err)
+		}
+		return plain, nil
+	}
+
+	for _, subKey := range v.AllKeys() {
+		switch value := v.Get(subKey).(type) {
+		case string:
+			if !IsConfSecret(value) {
+				continue
+			}
+			plain, err := decrypt(subKey, value)
+			if err != nil {
+				return nil, err
+			}
+			v.Set(subKey, plain)
+			decrypted = append(decrypted, subKey)
+		case []interface{}:
+			items := make([]interface{}, len(value))
+			changed := false
+			for i, item := range value {
+				items[i] = item
+				if s, ok := item.(string); ok && IsConfSecret(s) {
+					plain, err := decrypt(subKey, s)
+					if err != nil {
+						return nil, err
+					}
+					items[i] = plain
+					changed = true
+				}
+			}
+			if changed {
+				v.Set(subKey, items)
+				decrypted = append(decrypted, subKey)
+			}
+		}
+	}
+	return decrypted, nil
+}
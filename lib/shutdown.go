@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 退出时执行的清理函数，ctx 到期时应尽快返回
+type ShutdownHook func(ctx context.Context) error
+
+type shutdownHook struct {
+	name   string
+	budget time.Duration
+	hook   ShutdownHook
+}
+
+var (
+	shutdownLock  sync.Mutex
+	shutdownHooks []*shutdownHook
+)
+
+// 注册退出清理函数，退出时按注册的逆序执行
+// budget 为该函数允许的最长执行时间，为 0 时只受总超时限制
+func RegisterShutdownHook(name string, budget time.Duration, hook ShutdownHook) {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+	shutdownHooks = append(shutdownHooks, &shutdownHook{name: name, budget: budget, hook: hook})
+}
+
+// 单个清理函数执行失败或超时
+type HookError struct {
+	Name     string
+	Err      error
+	ProcTime time.Duration
+	Timeout  bool // 超出执行时间限制，函数可能仍在执行
+}
+
+func (e *HookError) Error() string {
+	if e.Timeout {
+		return fmt.Sprintf("%v: exceeded budget after %v", e.Name, e.ProcTime)
+	}
+	return fmt.Sprintf("%v: %v", e.Name, e.Err)
+}
+
+// 退出清理失败，包含所有失败或超时的清理函数
+type ShutdownError struct {
+	Failures []*HookError
+}
+
+func (e *ShutdownError) Error() string {
+	msgs := make([]string, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		msgs = append(msgs, f.Error())
+	}
+	return fmt.Sprintf("shutdown fail. %d hook(s) failed: %s", len(e.Failures), strings.Join(msgs, "; "))
+}
+
+// 阻塞等待 SIGINT/SIGTERM，收到信号后执行 Shutdown
+// 清理过程中再次收到信号时直接退出进程
+func WaitForShutdown(timeout time.Duration) error {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(ch)
+
+	sig := <-ch
+	log.Printf("[INFO] receive signal %v, start shutdown. timeout=%v\n", sig, timeout)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case sig := <-ch:
+			log.Printf("[ERROR] receive signal %v again, force exit.\n", sig)
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+	return Shutdown(timeout)
+}
+
+// 按注册的逆序执行清理函数，然后关闭模块、数据库连接池，刷新日志
+// 所有清理函数共享 timeout，超时未返回的函数不再等待
+func Shutdown(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	shutdownLock.Lock()
+	hooks := shutdownHooks
+	shutdownHooks = nil
+	shutdownLock.Unlock()
+
+	var failures []*HookError
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if failure := runShutdownHook(ctx, hooks[i]); failure != nil {
+			log.Printf("[ERROR] shutdown hook %s\n", failure.Error())
+			failures = append(failures, failure)
+		}
+	}
+
+	Destroy()
+	if len(failures) > 0 {
+		return &ShutdownError{Failures: failures}
+	}
+	return nil
+}
+
+func runShutdownHook(ctx context.Context, h *shutdownHook) *HookError {
+	if h.budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.budget)
+		defer cancel()
+	}
+
+	startTime := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				done <- fmt.Errorf("panic=%v", err)
+			}
+		}()
+		done <- h.hook(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return &HookError{Name: h.name, Err: err, ProcTime: time.Since(startTime)}
+		}
+		log.Printf("[INFO] shutdown hook %s success. proc_time=%fs\n", h.name, time.Since(startTime).Seconds())
+		return nil
+	case <-ctx.Done():
+		return &HookError{Name: h.name, Err: ctx.Err(), ProcTime: time.Since(startTime), Timeout: true}
+	}
+}
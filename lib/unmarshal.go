@@ -0,0 +1,185 @@
+package lib
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// 将已加载的配置段反序列化到结构体
+// key 为 文件名 或 文件名.配置段，如 UnmarshalConf("payment.gateway", &conf)
+// 字段按 mapstructure 标签匹配，配置中缺少的字段使用 default 标签的值，如
+//
+//	type GatewayConf struct {
+//		Addr    string            `mapstructure:"addr" default:"127.0.0.1:8080"`
+//		Timeout time.Duration     `mapstructure:"timeout" default:"3s"`
+//		Hosts   []string          `mapstructure:"hosts" default:"a.com,b.com"`
+//		Headers map[string]string `mapstructure:"headers" default:"x-env=dev,x-app=gateway"`
+//	}
+//
+// 数组的默认值按逗号分隔，map 的默认值为逗号分隔的 key=value，配置中存在该项时不使用默认值
+//
+// 反序列化后按 validate 标签校验，见 ValidateConf
+func UnmarshalConf(key string, conf interface{}) error {
+	return unmarshalConf(key, conf, false)
+}
+
+// 同 UnmarshalConf，配置中存在结构体未定义的字段时返回错误
+// 用于启动时发现配置项拼写错误
+func UnmarshalConfStrict(key string, conf interface{}) error {
+	return unmarshalConf(key, conf, true)
+}
+
+func unmarshalConf(key string, conf interface{}, strict bool) error {
+	rv := reflect.ValueOf(conf)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("unmarshal config [%v] fail. conf must be a non-nil pointer", key)
+	}
+
+	settings, err := confSection(key)
+	if err != nil {
+		return err
+	}
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		ErrorUnused:      strict,
+		WeaklyTypedInput: true,
+		Result:           conf,
+	})
+	if err != nil {
+		return err
+	}
+	if err := decoder.Decode(settings); err != nil {
+		return fmt.Errorf("unmarshal config [%v] fail. err=%v", key, err)
+	}
+	// 反序列化之后设置默认值，避免数组、map 类型的配置与默认值合并
+	if err := applyConfDefaults(rv.Elem(), settings); err != nil {
+		return fmt.Errorf("unmarshal config [%v] fail. err=%v", key, err)
+	}
+	keys := strings.SplitN(key, ".", 2)
+	if len(keys) < 2 {
+		keys = append(keys, "")
+	}
+	return validateConf(keys[0], keys[1], conf)
+}
+
+// 获取 文件名.配置段 对应的配置内容
+// 从 AllSettings 中逐层查找，保证环境变量覆盖的配置项也包含在内
+func confSection(key string) (map[string]interface{}, error) {
+	keys := strings.Split(key, ".")
+	v, ok := getViperConf(keys[0])
+	if !ok || v == nil {
+		return nil, fmt.Errorf("config file [%v] not found", keys[0])
+	}
+	section := v.AllSettings()
+	for i, k := range keys[1:] {
+		sub, ok := section[strings.ToLower(k)].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("config section [%v] not found", strings.Join(keys[:i+2], "."))
+		}
+		section = sub
+	}
+	return section, nil
+}
+
+// 配置中不存在且为零值的字段设置 default 标签的值，嵌套结构体按对应的配置段逐层处理
+func applyConfDefaults(rv reflect.Value, section map[string]interface{}) error {
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rv.Field(i)
+		if !field.CanSet() {
+			continue
+		}
+		if isConfSquash(rt.Field(i)) {
+			if err := applyConfDefaults(field, section); err != nil {
+				return err
+			}
+			continue
+		}
+		value, exists := confSectionValue(section, confFieldName(rt.Field(i)))
+		if def, ok := rt.Field(i).Tag.Lookup("default"); ok {
+			if !exists && isZeroValue(field) {
+				if err := decodeConfDefault(def, field); err != nil {
+					return fmt.Errorf("field %v default %q. %v", rt.Field(i).Name, def, err)
+				}
+			}
+			continue
+		}
+		sub, _ := value.(map[string]interface{})
+		if err := applyConfDefaults(field, sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapstructure 标签含 squash 时字段与上层结构体使用同一配置段
+func isConfSquash(sf reflect.StructField) bool {
+	parts := strings.Split(sf.Tag.Get("mapstructure"), ",")
+	for _, opt := range parts[1:] {
+		if opt == "squash" {
+			return true
+		}
+	}
+	return false
+}
+
+// 配置项名不区分大小写
+func confSectionValue(section map[string]interface{}, name string) (interface{}, bool) {
+	if value, ok := section[name]; ok {
+		return value, true
+	}
+	for key, value := range section {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+func decodeConfDefault(def string, field reflect.Value) error {
+	var input interface{} = def
+	if field.Kind() == reflect.Map {
+		m := map[string]interface{}{}
+		for _, item := range strings.Split(def, ",") {
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid map item %q", item)
+			}
+			m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		input = m
+	}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		WeaklyTypedInput: true,
+		Result:           field.Addr().Interface(),
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(input)
+}
+
+func isZeroValue(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
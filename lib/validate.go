@@ -0,0 +1,214 @@
+package lib
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 配置结构体自定义校验
+// ParseConfig、UnmarshalConf 反序列化后会调用
+type ConfValidator interface {
+	Validate() error
+}
+
+// 单个配置项校验失败
+type ConfError struct {
+	File   string
+	Key    string
+	Reason string
+}
+
+func (e *ConfError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("%v: %v", e.File, e.Reason)
+	}
+	return fmt.Sprintf("%v: %v: %v", e.File, e.Key, e.Reason)
+}
+
+// 配置校验失败列表
+type ConfErrors []*ConfError
+
+func (es ConfErrors) Error() string {
+	lines := make([]string, 0, len(es))
+	for _, e := range es {
+		lines = append(lines, e.Error())
+	}
+	return fmt.Sprintf("config validate fail. %d error(s):\n\t%s", len(es), strings.Join(lines, "\n\t"))
+}
+
+// 校验配置结构体，返回所有校验失败的配置项
+//
+// 支持 validate 标签，多个规则用逗号分隔:
+//
+//	required       必须配置且不为零值
+//	min=N max=N    数值的大小；字符串、数组、map 的长度
+//	oneof=a b c    取值范围，空格分隔
+//
+// 除 required 外，零值字段不做校验，便于后续设置默认值
+// 结构体实现 ConfValidator 时，标签校验后调用 Validate()
+func ValidateConf(file string, conf interface{}) error {
+	return validateConf(file, "", conf)
+}
+
+func validateConf(file string, prefix string, conf interface{}) error {
+	var errs ConfErrors
+	validateValue(file, prefix, reflect.ValueOf(conf), &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateValue(file string, key string, rv reflect.Value, errs *ConfErrors) {
+	if !rv.IsValid() {
+		return
+	}
+	if rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return
+		}
+		validateValue(file, key, rv.Elem(), errs)
+		return
+	}
+
+	switch rv.Kind() {
+	case reflect.Struct:
+		rt := rv.Type()
+		for i := 0; i < rt.NumField(); i++ {
+			sf := rt.Field(i)
+			if sf.PkgPath != "" {
+				continue
+			}
+			name := confFieldName(sf)
+			if name == "-" {
+				continue
+			}
+			fieldKey := joinConfKey(key, name)
+			field := rv.Field(i)
+			if rules, ok := sf.Tag.Lookup("validate"); ok {
+				for _, reason := range checkConfRules(field, rules) {
+					*errs = append(*errs, &ConfError{File: file, Key: fieldKey, Reason: reason})
+				}
+			}
+			validateValue(file, fieldKey, field, errs)
+		}
+	case reflect.Map:
+		keys := rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		for _, k := range keys {
+			validateValue(file, joinConfKey(key, fmt.Sprint(k.Interface())), rv.MapIndex(k), errs)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			validateValue(file, fmt.Sprintf("%s[%d]", key, i), rv.Index(i), errs)
+		}
+	}
+
+	// 自定义校验
+	var validator ConfValidator
+	if rv.CanAddr() {
+		validator, _ = rv.Addr().Interface().(ConfValidator)
+	}
+	if validator == nil && rv.CanInterface() {
+		validator, _ = rv.Interface().(ConfValidator)
+	}
+	if validator != nil {
+		if err := validator.Validate(); err != nil {
+			*errs = append(*errs, &ConfError{File: file, Key: key, Reason: err.Error()})
+		}
+	}
+}
+
+// 校验单个字段，返回失败原因
+func checkConfRules(field reflect.Value, rules string) (reasons []string) {
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		name, param := rule, ""
+		if idx := strings.Index(rule, "="); idx >= 0 {
+			name, param = rule[:idx], rule[idx+1:]
+		}
+
+		if name == "required" {
+			if isZeroValue(field) {
+				reasons = append(reasons, "is required")
+			}
+			continue
+		}
+		if isZeroValue(field) {
+			continue
+		}
+
+		switch name {
+		case "min", "max":
+			limit, err := strconv.ParseFloat(param, 64)
+			if err != nil {
+				reasons = append(reasons, fmt.Sprintf("invalid rule %q", rule))
+				continue
+			}
+			value, isLen, ok := confFieldSize(field)
+			if !ok {
+				reasons = append(reasons, fmt.Sprintf("rule %q not supported for %v", rule, field.Kind()))
+				continue
+			}
+			what := "value"
+			if isLen {
+				what = "length"
+			}
+			if name == "min" && value < limit {
+				reasons = append(reasons, fmt.Sprintf("%s %v less than min %v", what, value, param))
+			}
+			if name == "max" && value > limit {
+				reasons = append(reasons, fmt.Sprintf("%s %v greater than max %v", what, value, param))
+			}
+		case "oneof":
+			options := strings.Fields(param)
+			value := fmt.Sprint(field.Interface())
+			if !InArrayString(value, options) {
+				reasons = append(reasons, fmt.Sprintf("%q not one of [%s]", value, strings.Join(options, " ")))
+			}
+		default:
+			reasons = append(reasons, fmt.Sprintf("unknown rule %q", rule))
+		}
+	}
+	return
+}
+
+// 数值返回值本身，字符串、数组、map 返回长度
+func confFieldSize(field reflect.Value) (size float64, isLen bool, ok bool) {
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(field.Int()), false, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(field.Uint()), false, true
+	case reflect.Float32, reflect.Float64:
+		return field.Float(), false, true
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return float64(field.Len()), true, true
+	}
+	return 0, false, false
+}
+
+// 字段对应的配置项名，与 mapstructure 标签一致
+func confFieldName(sf reflect.StructField) string {
+	if tag, ok := sf.Tag.Lookup("mapstructure"); ok {
+		if name := strings.Split(tag, ",")[0]; name != "" {
+			return name
+		}
+	}
+	return strings.ToLower(sf.Name)
+}
+
+func joinConfKey(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
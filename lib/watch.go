@@ -0,0 +1,273 @@
+package lib
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// 配置变更回调
+// key 为注册时的监听键
+// 监听整个文件时 oldValue/newValue 为 *viper.Viper，文件新建或删除时对应一侧为 nil
+// 监听具体配置项时 oldValue/newValue 为该配置项变更前后的值
+type ConfChangeFunc func(key string, oldValue, newValue interface{})
+
+// 同一文件的连续事件合并处理的等待时间（编辑器保存时通常会触发多次写事件）
+var ConfReloadDelay = 100 * time.Millisecond
+
+// Kubernetes ConfigMap/Secret 挂载的文件夹中，配置文件是指向 ..data/ 的符号链接
+// 更新时替换 ..data 符号链接，配置文件本身没有事件
+const confAtomicDataDir = "..data"
+
+var (
+	confLock       sync.RWMutex // 保护 ViperConfMap 的替换
+	reloadLock     sync.Mutex   // 串行化文件重载
+	callbackLock   sync.RWMutex
+	confCallbacks  = map[string][]ConfChangeFunc{}
+	watchLock      sync.Mutex
+	confWatcher    *fsnotify.Watcher
+	confWatchDone  chan struct{}
+	confWatchTimer map[string]*time.Timer
+)
+
+// 注册配置变更回调
+// key 为文件名时监听整个文件，如 OnConfChange("base", fn)
+// key 为 文件名.配置项 时只在该配置项的值变化时回调，如 OnConfChange("base.log.log_level", fn)
+func OnConfChange(key string, fn ConfChangeFunc) {
+	if key == "" || fn == nil {
+		return
+	}
+	callbackLock.Lock()
+	defer callbackLock.Unlock()
+	confCallbacks[key] = append(confCallbacks[key], fn)
+}
+
+// 开始监听配置文件夹，包括 ConfLayers 中的所有配置层
+// 文件新建、修改、删除后重新加载对应的 ViperConfMap 条目并触发回调
+// ..data 符号链接替换后重新加载所有配置文件
+// 重复调用不会创建多个监听
+func WatchConf() error {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	if confWatcher != nil {
+		return nil
+	}
+	if ConfEnvPath == "" {
+		return fmt.Errorf("watch config fail. empty config path")
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("watch config path [%v] fail. err=%v", ConfEnvPath, err)
+	}
+	for _, dir := range ConfLayers() {
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return fmt.Errorf("watch config path [%v] fail. err=%v", dir, err)
+		}
+	}
+	confWatcher = w
+	confWatchDone = make(chan struct{})
+	confWatchTimer = map[string]*time.Timer{}
+	go watchConfLoop(w, confWatchDone)
+	return nil
+}
+
+// 停止监听配置文件夹
+func StopWatchConf() {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	if confWatcher == nil {
+		return
+	}
+	close(confWatchDone)
+	confWatcher.Close()
+	for _, t := range confWatchTimer {
+		t.Stop()
+	}
+	confWatcher = nil
+	confWatchDone = nil
+	confWatchTimer = nil
+}
+
+func watchConfLoop(w *fsnotify.Watcher, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case event, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+			fileName := filepath.Base(event.Name)
+			if fileName == confAtomicDataDir {
+				scheduleAllConfReload(done)
+				continue
+			}
+			if isIgnoredConfFile(fileName) {
+				continue
+			}
+			if _, ok := GetConfType(fileName); !ok {
+				continue
+			}
+			scheduleConfReload(confFileName(fileName), done)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			fmt.Printf("[WARN] %s %s\n", time.Now().Format(TimeFormat), "WatchConf:"+err.Error())
+		}
+	}
+}
+
+// 合并同一文件短时间内的多次事件
+func scheduleConfReload(name string, done chan struct{}) {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	if confWatchTimer == nil {
+		return
+	}
+	if t, ok := confWatchTimer[name]; ok {
+		t.Stop()
+	}
+	confWatchTimer[name] = time.AfterFunc(ConfReloadDelay, func() {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if err := reloadConf(name); err != nil {
+			fmt.Printf("[WARN] %s %s\n", time.Now().Format(TimeFormat), "ReloadConf:"+err.Error())
+		}
+	})
+}
+
+// 重新加载已加载的和配置层中现有的所有配置文件
+func scheduleAllConfReload(done chan struct{}) {
+	names, err := listConfNames()
+	if err != nil {
+		fmt.Printf("[WARN] %s %s\n", time.Now().Format(TimeFormat), "ReloadConf:"+err.Error())
+		return
+	}
+	confLock.RLock()
+	for name := range ViperConfMap {
+		if !InArrayString(name, names) {
+			names = append(names, name)
+		}
+	}
+	confLock.RUnlock()
+	for _, name := range names {
+		scheduleConfReload(name, done)
+	}
+}
+
+// 编辑器临时文件、隐藏文件不做处理
+func isIgnoredConfFile(fileName string) bool {
+	return fileName == "" ||
+		strings.HasPrefix(fileName, ".") ||
+		strings.HasSuffix(fileName, "~") ||
+		strings.HasSuffix(fileName, ".swp") ||
+		strings.HasSuffix(fileName, ".tmp")
+}
+
+// 重新加载 name 配置文件并替换 ViperConfMap 中的条目
+// 解析失败时保留旧配置
+func reloadConf(name string) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	newConf, sources, literal, err := loadViperConf(name)
+	if err != nil {
+		return err
+	}
+	if newConf != nil {
+		if err := interpolateLoadedConf(name, newConf, literal); err != nil {
+			return err
+		}
+	}
+
+	confLock.Lock()
+	oldConf := ViperConfMap[name]
+	if oldConf == nil && newConf == nil {
+		confLock.Unlock()
+		return nil
+	}
+	confMap := make(map[string]*viper.Viper, len(ViperConfMap)+1)
+	for k, v := range ViperConfMap {
+		confMap[k] = v
+	}
+	sourceMap := make(map[string]map[string]string, len(confSources)+1)
+	for k, v := range confSources {
+		sourceMap[k] = v
+	}
+	if newConf == nil {
+		delete(confMap, name)
+		delete(sourceMap, name)
+	} else {
+		confMap[name] = newConf
+		sourceMap[name] = sources
+	}
+	ViperConfMap = confMap
+	confSources = sourceMap
+	confLock.Unlock()
+
+	fireConfChange(name, oldConf, newConf)
+	return nil
+}
+
+// 触发 name 文件相关的回调
+func fireConfChange(name string, oldConf, newConf *viper.Viper) {
+	callbackLock.RLock()
+	callbacks := map[string][]ConfChangeFunc{}
+	for key, fns := range confCallbacks {
+		if key == name || strings.HasPrefix(key, name+".") {
+			callbacks[key] = append([]ConfChangeFunc{}, fns...)
+		}
+	}
+	callbackLock.RUnlock()
+
+	for key, fns := range callbacks {
+		var oldValue, newValue interface{}
+		if key == name {
+			if oldConf != nil {
+				oldValue = oldConf
+			}
+			if newConf != nil {
+				newValue = newConf
+			}
+		} else {
+			subKey := key[len(name)+1:]
+			if oldConf != nil {
+				oldValue = oldConf.Get(subKey)
+			}
+			if newConf != nil {
+				newValue = newConf.Get(subKey)
+			}
+			if reflect.DeepEqual(oldValue, newValue) {
+				continue
+			}
+		}
+		for _, fn := range fns {
+			callConfChange(fn, key, oldValue, newValue)
+		}
+	}
+}
+
+// 回调 panic 不影响监听协程
+func callConfChange(fn ConfChangeFunc, key string, oldValue, newValue interface{}) {
+	defer func() {
+		if err := recover(); err != nil {
+			fmt.Printf("[ERROR] %s %s\n", time.Now().Format(TimeFormat), fmt.Sprintf("OnConfChange:%v panic=%v", key, err))
+		}
+	}()
+	fn(key, oldValue, newValue)
+}
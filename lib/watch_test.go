@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// 测试配置文件热加载及变更回调
+func TestWatchConf(t *testing.T) {
+	root := setupTestConf(t, map[string]string{
+		"base.toml": "[log]\nlog_level = \"trace\"\n",
+	})
+	defer os.RemoveAll(root)
+	dir := ConfEnvPath
+
+	if err := WatchConf(); err != nil {
+		t.Fatal(err)
+	}
+	defer StopWatchConf()
+
+	callbackLock.Lock()
+	confCallbacks = map[string][]ConfChangeFunc{}
+	callbackLock.Unlock()
+	changed := make(chan interface{}, 1)
+	OnConfChange("base.log.log_level", func(key string, oldValue, newValue interface{}) {
+		changed <- newValue
+	})
+	created := make(chan interface{}, 1)
+	OnConfChange("feature", func(key string, oldValue, newValue interface{}) {
+		created <- newValue
+	})
+
+	if err := ioutil.WriteFile(dir+"/base.toml", []byte("[log]\nlog_level = \"info\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case v := <-changed:
+		if v != "info" {
+			t.Fatalf("new value=%v", v)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("base.log.log_level change not notified")
+	}
+	if GetStringConf("base.log.log_level") != "info" {
+		t.Fatalf("log_level=%v", GetStringConf("base.log.log_level"))
+	}
+
+	if err := ioutil.WriteFile(dir+"/feature.toml", []byte("on = true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case v := <-created:
+		if v == nil {
+			t.Fatal("feature created with nil conf")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("feature file create not notified")
+	}
+
+	os.Remove(dir + "/feature.toml")
+	select {
+	case v := <-created:
+		if v != nil {
+			t.Fatalf("feature removed with conf=%v", v)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("feature file remove not notified")
+	}
+	if GetStringConf("feature.on") != "" {
+		t.Fatal("feature conf still exists")
+	}
+}
+
+// 测试 Kubernetes ConfigMap 挂载方式：替换 ..data 符号链接更新配置
+func TestWatchConfSymlink(t *testing.T) {
+	root := writeTestConf(t, map[string]string{
+		"dev/..v1/base.toml": "[log]\nlog_level = \"trace\"\n",
+		"dev/..v2/base.toml": "[log]\nlog_level = \"info\"\n",
+	})
+	defer os.RemoveAll(root)
+	dir := ConfEnvPath
+	if err := os.Symlink("..v1", dir+"/..data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..data/base.toml", dir+"/base.toml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitViperConf(); err != nil {
+		t.Fatal(err)
+	}
+	if GetStringConf("base.log.log_level") != "trace" {
+		t.Fatalf("log_level=%v", GetStringConf("base.log.log_level"))
+	}
+
+	if err := WatchConf(); err != nil {
+		t.Fatal(err)
+	}
+	defer StopWatchConf()
+	callbackLock.Lock()
+	confCallbacks = map[string][]ConfChangeFunc{}
+	callbackLock.Unlock()
+	changed := make(chan interface{}, 1)
+	OnConfChange("base.log.log_level", func(key string, oldValue, newValue interface{}) {
+		changed <- newValue
+	})
+
+	// 与 kubelet 相同，先创建临时符号链接再原子替换 ..data
+	if err := os.Symlink("..v2", dir+"/..data_tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(dir+"/..data_tmp", dir+"/..data"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case v := <-changed:
+		if v != "info" {
+			t.Fatalf("new value=%v", v)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("base.log.log_level change not notified")
+	}
+}
@@ -52,10 +52,12 @@ type Flusher interface {
 
 type Logger struct {
 	writers     []Writer
+	writersLock sync.RWMutex // 写入协程运行期间也可以注册 writer
 	tunnel      chan *Record
 	level       int
 	lastTime    int64
 	lastTimeStr string
+	timeLock    sync.Mutex
 	c           chan bool
 	layout      string
 	recordPool  *sync.Pool
@@ -84,7 +86,9 @@ func (l *Logger) Register(w Writer) {
 	if err := w.Init(); err != nil {
 		panic(err)
 	}
+	l.writersLock.Lock()
 	l.writers = append(l.writers, w)
+	l.writersLock.Unlock()
 }
 
 func (l *Logger) SetLevel(lvl int) {
@@ -122,6 +126,8 @@ func (l *Logger) Fatal(fmt string, args ...interface{}) {
 func (l *Logger) Close() {
 	close(l.tunnel)
 	<-l.c
+	l.writersLock.RLock()
+	defer l.writersLock.RUnlock()
 	for _, w := range l.writers {
 		if f, ok := w.(Flusher); ok {
 			if err := f.Flush(); err != nil {
@@ -152,14 +158,17 @@ func (l *Logger) deliverRecordToWriter(level int, format string, args ...interfa
 
 	// format time
 	now := time.Now()
+	l.timeLock.Lock()
 	if now.Unix() != l.lastTime {
 		l.lastTime = now.Unix()
 		l.lastTimeStr = now.Format(l.layout)
 	}
+	timeStr := l.lastTimeStr
+	l.timeLock.Unlock()
 	r := l.recordPool.Get().(*Record)
 	r.info = inf
 	r.code = code
-	r.time = l.lastTimeStr
+	r.time = timeStr
 	r.level = level
 
 	l.tunnel <- r
@@ -180,11 +189,13 @@ func boostrapLogWriter(logger *Logger) {
 		return
 	}
 
+	logger.writersLock.RLock()
 	for _, w := range logger.writers {
 		if err := w.Write(r); err != nil {
 			log.Println(err)
 		}
 	}
+	logger.writersLock.RUnlock()
 
 	flushTimer := time.NewTimer(time.Millisecond * 500)
 	rotateTimer := time.NewTimer(time.Second * 10)
@@ -196,15 +207,18 @@ func boostrapLogWriter(logger *Logger) {
 				logger.c <- true
 				return
 			}
+			logger.writersLock.RLock()
 			for _, w := range logger.writers {
 				if err := w.Write(r); err != nil {
 					log.Println(err)
 				}
 			}
+			logger.writersLock.RUnlock()
 
 			logger.recordPool.Put(r)
 
 		case <-flushTimer.C:
+			logger.writersLock.RLock()
 			for _, w := range logger.writers {
 				if f, ok := w.(Flusher); ok {
 					if err := f.Flush(); err != nil {
@@ -212,9 +226,11 @@ func boostrapLogWriter(logger *Logger) {
 					}
 				}
 			}
+			logger.writersLock.RUnlock()
 			flushTimer.Reset(time.Millisecond * 1000)
 
 		case <-rotateTimer.C:
+			logger.writersLock.RLock()
 			for _, w := range logger.writers {
 				if r, ok := w.(Rotater); ok {
 					if err := r.Rotate(); err != nil {
@@ -222,6 +238,7 @@ func boostrapLogWriter(logger *Logger) {
 					}
 				}
 			}
+			logger.writersLock.RUnlock()
 			rotateTimer.Reset(time.Second * 10)
 		}
 	}
@@ -231,6 +248,7 @@ func boostrapLogWriter(logger *Logger) {
 var (
 	logger_default *Logger
 	takeup         = false
+	defaultLock    sync.Mutex
 )
 
 func SetLevel(lvl int) {
@@ -280,12 +298,17 @@ func Register(w Writer) {
 
 func Close() {
 	defaultLoggerInit()
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
 	logger_default.Close()
 	logger_default = nil
 	takeup = false
 }
 
+// 多个 goroutine 同时首次写日志时只初始化一次
 func defaultLoggerInit() {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
 	if takeup==false{
 		logger_default = NewLogger()
 	}